@@ -0,0 +1,145 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+// Request to set the administrative state of a mirror
+type adminRequest struct {
+	State		string `json:"state"`     // disabled, maintenance
+	Reason		string `json:"reason"`
+	// Optional expiry, either as a time (RFC 3339) or a duration from
+	// now (e.g., "2h30m")
+	Until		string `json:"until"`
+	Duration	string `json:"duration"`
+}
+
+
+// Authenticate the admin requests by the bearer token in the
+// "Authorization" header.
+//
+func AdminAuth(c *gin.Context) {
+	token := appConfig.Admin.Token
+	auth := c.GetHeader("Authorization")
+	const prefix = "Bearer "
+	if token == "" || !strings.HasPrefix(auth, prefix) ||
+	   subtle.ConstantTimeCompare([]byte(auth[len(prefix):]),
+			[]byte(token)) != 1 {
+		common.WithFields(common.Fields{
+			"client_ip": common.AnonymizeIPString(c.ClientIP()),
+		}).Warnf("Unauthorized admin request: %s %s\n",
+				c.Request.Method, c.Request.URL.Path)
+		c.Header("WWW-Authenticate", `Bearer realm="mirrorselect"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized,
+				gin.H{ "error": "unauthorized" })
+		return
+	}
+	c.Next()
+}
+
+// Put the mirror into the disabled/maintenance state.
+//
+func PutAdminState(c *gin.Context) {
+	name := c.Param("name")
+	if _, ok := appConfig.Mirrors[name]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{ "error": "unknown mirror" })
+		return
+	}
+
+	var req adminRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{ "error": err.Error() })
+		return
+	}
+	now := time.Now()
+	state, err := newAdminState(&req, now)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{ "error": err.Error() })
+		return
+	}
+
+	if err := common.SetAdminState(name, state); err != nil {
+		common.ErrorPrintf("Failed to set admin state of mirror [%s]: %v\n",
+				name, err)
+		c.JSON(http.StatusInternalServerError,
+				gin.H{ "error": err.Error() })
+		return
+	}
+	common.WithFields(common.Fields{
+		"mirror": name,
+		"state": state.State,
+		"reason": state.Reason,
+		"client_ip": common.AnonymizeIPString(c.ClientIP()),
+	}).Infof("Mirror [%s] set to %s state: %s\n",
+			name, state.State, state.Reason)
+	c.JSON(http.StatusOK, gin.H{ "mirror": name, "admin": state })
+}
+
+// Clear the administrative state of the mirror.
+//
+func DeleteAdminState(c *gin.Context) {
+	name := c.Param("name")
+	if _, ok := appConfig.Mirrors[name]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{ "error": "unknown mirror" })
+		return
+	}
+
+	if err := common.SetAdminState(name, nil); err != nil {
+		common.ErrorPrintf("Failed to clear admin state of mirror [%s]: %v\n",
+				name, err)
+		c.JSON(http.StatusInternalServerError,
+				gin.H{ "error": err.Error() })
+		return
+	}
+	common.WithFields(common.Fields{
+		"mirror": name,
+		"client_ip": common.AnonymizeIPString(c.ClientIP()),
+	}).Infof("Mirror [%s] admin state cleared.\n", name)
+	c.JSON(http.StatusOK, gin.H{ "mirror": name, "admin": nil })
+}
+
+func newAdminState(req *adminRequest, now time.Time) (*common.AdminState, error) {
+	state := &common.AdminState{
+		State: strings.ToLower(req.State),
+		Reason: req.Reason,
+		Since: now,
+	}
+	if state.State != common.AdminDisabled &&
+	   state.State != common.AdminMaintenance {
+		return nil, fmt.Errorf("state must be %s or %s",
+				common.AdminDisabled, common.AdminMaintenance)
+	}
+
+	var until time.Time
+	switch {
+	case req.Until != "" && req.Duration != "":
+		return nil, fmt.Errorf("only one of until and duration allowed")
+	case req.Until != "":
+		t, err := time.Parse(time.RFC3339, req.Until)
+		if err != nil {
+			return nil, fmt.Errorf("invalid until: %v", err)
+		}
+		until = t
+	case req.Duration != "":
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration: %v", err)
+		}
+		until = now.Add(d)
+	default:
+		return state, nil
+	}
+	if !until.After(now) {
+		return nil, fmt.Errorf("expiry in the past: %v", until)
+	}
+	state.Until = &until
+	return state, nil
+}
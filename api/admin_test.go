@@ -0,0 +1,262 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+const testToken = "0123456789abcdef0123"
+
+
+// Setup the config with the test mirrors and a router of the admin API.
+//
+func setupAdminRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	common.ReadConfig("../testdata/mirrorselect.toml")
+	appConfig.Admin.Token = testToken
+	appConfig.Admin.StateFile = ""
+	t.Cleanup(func() {
+		appConfig.Admin.Token = ""
+		for _, mirror := range appConfig.Mirrors {
+			mirror.Status.Admin = nil
+		}
+	})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	admin := router.Group("/admin", AdminAuth)
+	admin.GET("/ping", GetPing)
+	admin.PUT("/mirrors/:name", PutAdminState)
+	admin.DELETE("/mirrors/:name", DeleteAdminState)
+	return router
+}
+
+func doRequest(router *gin.Engine, method, path, auth,
+		body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+
+func TestAdminAuth(t *testing.T) {
+	router := setupAdminRouter(t)
+
+	cases := []struct {
+		token string  // configured
+		auth string
+		code int
+	}{
+		{ testToken, "", http.StatusUnauthorized },
+		{ testToken, "Basic " + testToken, http.StatusUnauthorized },
+		{ testToken, "bearer " + testToken, http.StatusUnauthorized },
+		{ testToken, "Bearer", http.StatusUnauthorized },
+		{ testToken, "Bearer wrong", http.StatusUnauthorized },
+		{ testToken, "Bearer " + testToken + "x", http.StatusUnauthorized },
+		{ testToken, "Bearer " + testToken, http.StatusOK },
+		// Never authenticated without a configured token
+		{ "", "Bearer ", http.StatusUnauthorized },
+	}
+	for _, tc := range cases {
+		appConfig.Admin.Token = tc.token
+		w := doRequest(router, "GET", "/admin/ping", tc.auth, "")
+		if w.Code != tc.code {
+			t.Errorf("GET /admin/ping (token %q, auth %q) = %d, want %d",
+					tc.token, tc.auth, w.Code, tc.code)
+		}
+		if w.Code == http.StatusUnauthorized &&
+		   w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("GET /admin/ping (auth %q): no WWW-Authenticate",
+					tc.auth)
+		}
+	}
+}
+
+
+func TestNewAdminState(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		req adminRequest
+		ok bool
+		until time.Time  // zero if no expiry
+	}{
+		{ adminRequest{ State: "disabled" }, true, time.Time{} },
+		{ adminRequest{ State: "Maintenance" }, true, time.Time{} },
+		{ adminRequest{ State: "" }, false, time.Time{} },
+		{ adminRequest{ State: "offline" }, false, time.Time{} },
+		{
+			adminRequest{
+				State: "maintenance",
+				Until: "2026-10-20T00:00:00Z",
+			},
+			true,
+			time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			adminRequest{ State: "maintenance", Duration: "2h30m" },
+			true,
+			now.Add(150 * time.Minute),
+		},
+		{
+			adminRequest{ State: "maintenance", Until: "2026-10-19" },
+			false,
+			time.Time{},
+		},
+		{
+			adminRequest{ State: "maintenance", Duration: "2 hours" },
+			false,
+			time.Time{},
+		},
+		// Expiry in the past
+		{
+			adminRequest{
+				State: "maintenance",
+				Until: "2026-10-19T11:00:00Z",
+			},
+			false,
+			time.Time{},
+		},
+		{
+			adminRequest{ State: "maintenance", Duration: "-1h" },
+			false,
+			time.Time{},
+		},
+		{
+			adminRequest{ State: "maintenance", Duration: "0s" },
+			false,
+			time.Time{},
+		},
+		// Both given
+		{
+			adminRequest{
+				State: "maintenance",
+				Until: "2026-10-20T00:00:00Z",
+				Duration: "1h",
+			},
+			false,
+			time.Time{},
+		},
+	}
+	for _, tc := range cases {
+		state, err := newAdminState(&tc.req, now)
+		if (err == nil) != tc.ok {
+			t.Errorf("newAdminState(%+v) = %v, want ok = %v",
+					tc.req, err, tc.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !state.Since.Equal(now) {
+			t.Errorf("newAdminState(%+v): since = %v, want %v",
+					tc.req, state.Since, now)
+		}
+		if tc.until.IsZero() {
+			if state.Until != nil {
+				t.Errorf("newAdminState(%+v): until = %v, want none",
+						tc.req, *state.Until)
+			}
+		} else if state.Until == nil || !state.Until.Equal(tc.until) {
+			t.Errorf("newAdminState(%+v): until = %v, want %v",
+					tc.req, state.Until, tc.until)
+		}
+	}
+}
+
+
+func TestAdminMirrors(t *testing.T) {
+	router := setupAdminRouter(t)
+	auth := "Bearer " + testToken
+	mirror := appConfig.Mirrors["sjtug"]
+
+	cases := []struct {
+		method, path, body string
+		code int
+	}{
+		{ "PUT", "/admin/mirrors/nonexist", `{"state": "disabled"}`,
+				http.StatusNotFound },
+		{ "DELETE", "/admin/mirrors/nonexist", "", http.StatusNotFound },
+		{ "PUT", "/admin/mirrors/sjtug", `{"state": `,
+				http.StatusBadRequest },
+		{ "PUT", "/admin/mirrors/sjtug", `{"state": "offline"}`,
+				http.StatusBadRequest },
+		{ "PUT", "/admin/mirrors/sjtug",
+				`{"state": "maintenance", "until": "2000-01-01T00:00:00Z"}`,
+				http.StatusBadRequest },
+	}
+	for _, tc := range cases {
+		w := doRequest(router, tc.method, tc.path, auth, tc.body)
+		if w.Code != tc.code {
+			t.Errorf("%s %s %s = %d, want %d", tc.method, tc.path,
+					tc.body, w.Code, tc.code)
+		}
+	}
+	if mirror.Status.Admin != nil {
+		t.Fatalf("Admin state set by bad requests: %+v",
+				mirror.Status.Admin)
+	}
+
+	w := doRequest(router, "PUT", "/admin/mirrors/sjtug", auth,
+			`{"state": "maintenance", "reason": "disk", "duration": "1h"}`)
+	a := mirror.AdminState(time.Now())
+	if w.Code != http.StatusOK || a == nil ||
+	   a.State != common.AdminMaintenance || a.Reason != "disk" ||
+	   a.Until == nil {
+		t.Errorf("PUT /admin/mirrors/sjtug = %d (%s), state = %+v",
+				w.Code, w.Body.String(), a)
+	}
+
+	w = doRequest(router, "DELETE", "/admin/mirrors/sjtug", auth, "")
+	if w.Code != http.StatusOK || mirror.Status.Admin != nil {
+		t.Errorf("DELETE /admin/mirrors/sjtug = %d, state = %+v",
+				w.Code, mirror.Status.Admin)
+	}
+}
+
+
+func TestGetMirrorsAdmin(t *testing.T) {
+	router := setupAdminRouter(t)
+	router.GET("/mirrors", GetMirrors)
+
+	// Expired states are hidden.
+	past := time.Now().Add(-time.Minute)
+	appConfig.Mirrors["sjtug"].Status.Admin = &common.AdminState{
+		State: common.AdminDisabled,
+		Until: &past,
+	}
+	w := doRequest(router, "GET", "/mirrors", "", "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(),
+			common.AdminDisabled) {
+		t.Errorf("GET /mirrors = %d, shows expired state: %s",
+				w.Code, w.Body.String())
+	}
+
+	// Not racing with the admin API (go test -race)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			common.SetAdminState("sjtug", &common.AdminState{
+				State: common.AdminMaintenance,
+			})
+			common.SetAdminState("sjtug", nil)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		GetMirrors(c)
+	}
+	<-done
+}
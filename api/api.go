@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -33,7 +35,8 @@ func GetIP(c *gin.Context) {
 
 	location, err := geoip.LookupIP(ip)
 	if err != nil {
-		common.DebugPrintf("Lookup IP (%s) error: %v\n", ip.String(), err)
+		common.DebugPrintf("Lookup IP (%s) error: %v\n",
+				common.AnonymizeIP(ip).String(), err)
 	}
 
 	info := fmt.Sprintf("IP: %s\n", ip.String())
@@ -44,6 +47,19 @@ func GetIP(c *gin.Context) {
 				location.ContinentCode, location.CountryCode)
 		info += fmt.Sprintf("Latitude: %v\nLongitude: %v\n",
 				location.Latitude, location.Longitude)
+		if !location.HasCoordinates {
+			info += fmt.Sprintf("Coordinates: country centroid\n")
+		} else if location.AccuracyRadius != 0 {
+			info += fmt.Sprintf("Accuracy radius: %d km\n",
+					location.AccuracyRadius)
+		}
+		if location.ASN != 0 {
+			info += fmt.Sprintf("ASN: %d\n", location.ASN)
+		}
+		if location.Override != nil {
+			info += fmt.Sprintf("Override: %s\n",
+					location.Override.Network.String())
+		}
 	}
 	c.String(http.StatusOK, info)
 }
@@ -51,7 +67,12 @@ func GetIP(c *gin.Context) {
 // Return current status of all mirrors.
 //
 func GetMirrors(c *gin.Context) {
-	c.JSON(http.StatusOK, appConfig.Mirrors)
+	now := time.Now()
+	mirrors := make(map[string]*common.Mirror, len(appConfig.Mirrors))
+	for name, mirror := range appConfig.Mirrors {
+		mirrors[name] = mirror.Snapshot(now)
+	}
+	c.JSON(http.StatusOK, mirrors)
 }
 
 // Return mirrors based on the client's location.
@@ -66,16 +87,74 @@ func GetPkgMirrors(c *gin.Context) {
 
 	location, err := geoip.LookupIP(ip)
 	if err != nil {
-		common.DebugPrintf("Lookup IP (%s) error: %v\n", ip.String(), err)
+		common.DebugPrintf("Lookup IP (%s) error: %v\n",
+				common.AnonymizeIP(ip).String(), err)
+	}
+
+	minMirrors, maxMirrors, err := mirrorLimits(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid mirror limits: %v\n", err)
+		return
 	}
-	common.DebugPrintf("Client IP: %s, Location: %v\n", ip.String(), location)
 
-	mirrors := geoip.FindMirrors(location)
+	selections := geoip.SelectMirrors(&geoip.Client{
+		IP: ip,
+		Location: location,
+		ABI: c.Param("abi"),
+		Header: c.Request.Header,
+		MinMirrors: minMirrors,
+		MaxMirrors: maxMirrors,
+	})
+	tier := selections[0].Reason
 	urls := ""
-	for _, m := range mirrors {
+	names := []string{}
+	reasons := []string{}
+	for _, s := range selections {
 		urls += fmt.Sprintf("URL: %s/%s/%s\n",
-				strings.TrimSuffix(m.URL, "/"), c.Param("abi"),
+				strings.TrimSuffix(s.URL, "/"),
+				c.Param("abi"),
 				strings.TrimPrefix(c.Param("path"), "/"))
+		names = append(names, s.Mirror.Name)
+		reasons = append(reasons, s.Reason)
 	}
 	c.String(http.StatusOK, urls)
+
+	logSelection(ip, location, c.Param("abi"), tier, selections)
+
+	if common.DebugEnabled() {
+		clientIP := common.AnonymizeIP(ip).String()
+		fields := common.Fields{
+			"client_ip": clientIP,
+			"abi": c.Param("abi"),
+			"tier": tier,
+			"mirrors": names,
+			"reasons": reasons,
+		}
+		if location != nil {
+			fields["continent"] = location.ContinentCode
+			fields["country"] = location.CountryCode
+		}
+		common.WithFields(fields).Debugf(
+				"Client IP: %s, Location: %v\n", clientIP, location)
+	}
+}
+
+// Get the limits on the number of returned mirrors from the query
+// parameters "min_mirrors" and "max_mirrors", which default to the config.
+//
+func mirrorLimits(c *gin.Context) (int, int, error) {
+	limits := []int{ appConfig.MinMirrors, appConfig.MaxMirrors }
+	for i, key := range []string{ "min_mirrors", "max_mirrors" } {
+		value, ok := c.GetQuery(key)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %v", key, err)
+		}
+		limits[i] = n
+	}
+	err := common.CheckMirrorLimits(limits[0], limits[1])
+	return limits[0], limits[1], err
 }
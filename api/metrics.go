@@ -0,0 +1,90 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+
+// Return the mirror status as metrics in the Prometheus text format.
+//
+func GetMetrics(c *gin.Context) {
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8",
+			[]byte(formatMetrics(appConfig.Mirrors)))
+}
+
+func formatMetrics(mirrors map[string]*common.Mirror) string {
+	names := make([]string, 0, len(mirrors))
+	for name := range mirrors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	metric := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n",
+				name, help, name)
+	}
+
+	metric("mirrorselect_mirror_up",
+			"Whether the mirror is online (per address family).")
+	for _, name := range names {
+		st := &mirrors[name].Status
+		fmt.Fprintf(&b, "mirrorselect_mirror_up{mirror=%q} %d\n",
+				name, boolValue(st.Online))
+		fmt.Fprintf(&b, "mirrorselect_mirror_up{mirror=%q,family=\"ipv4\"} %d\n",
+				name, boolValue(st.Online4))
+		fmt.Fprintf(&b, "mirrorselect_mirror_up{mirror=%q,family=\"ipv6\"} %d\n",
+				name, boolValue(st.Online6))
+	}
+
+	metric("mirrorselect_mirror_latency_milliseconds",
+			"Latency of the last successful check of the mirror.")
+	for _, name := range names {
+		fmt.Fprintf(&b, "mirrorselect_mirror_latency_milliseconds{mirror=%q} %d\n",
+				name, mirrors[name].Status.Latency)
+	}
+
+	metric("mirrorselect_mirror_throughput_bytes_per_second",
+			"Download throughput of the last probe of the mirror.")
+	for _, name := range names {
+		fmt.Fprintf(&b, "mirrorselect_mirror_throughput_bytes_per_second{mirror=%q} %d\n",
+				name, mirrors[name].Status.Throughput)
+	}
+
+	metric("mirrorselect_mirror_cert_expiring",
+			"Whether a certificate of the mirror expires soon.")
+	for _, name := range names {
+		fmt.Fprintf(&b, "mirrorselect_mirror_cert_expiring{mirror=%q} %d\n",
+				name, boolValue(mirrors[name].Status.CertExpiring))
+	}
+
+	metric("mirrorselect_cert_not_after_seconds",
+			"Expiry time (Unix) of the earliest expiring certificate in the chain.")
+	for _, name := range names {
+		mirror := mirrors[name]
+		for _, u := range mirror.AllURLs() {
+			st := mirror.Status.URLs[u]
+			if st == nil || st.Cert == nil || st.Cert.NotAfter.IsZero() {
+				continue
+			}
+			fmt.Fprintf(&b, "mirrorselect_cert_not_after_seconds{mirror=%q,url=%q} %d\n",
+					name, u, st.Cert.NotAfter.Unix())
+		}
+	}
+
+	return b.String()
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+	"github.com/DragonFlyBSD/mirrorselect/geoip"
+)
+
+// A record in the selection log (one JSON object per line).
+//
+type selectionRecord struct {
+	Time		string   `json:"time"`
+	ClientIP	string   `json:"client_ip"`
+	ContinentCode	string   `json:"continent_code"`
+	CountryCode	string   `json:"country_code"`
+	ASN		uint     `json:"asn,omitempty"`
+	ABI		string   `json:"abi"`
+	Tier		string   `json:"tier"`
+	Mirrors		[]string `json:"mirrors"`
+	Reasons		[]string `json:"reasons"`
+}
+
+
+// Record the mirror selection decision to the selection log if enabled.
+//
+func logSelection(ip net.IP, location *geoip.Location, abi string,
+		tier string, selections []*geoip.Selection) {
+	lf := appConfig.Log.Selection
+	if lf == nil {
+		return
+	}
+
+	record := selectionRecord{
+		Time:     time.Now().Format(time.RFC3339),
+		ClientIP: common.AnonymizeIP(ip).String(),
+		ABI:      abi,
+		Tier:     tier,
+		Mirrors:  []string{},
+		Reasons:  []string{},
+	}
+	if location != nil {
+		record.ContinentCode = location.ContinentCode
+		record.CountryCode = location.CountryCode
+		record.ASN = location.ASN
+	}
+	for _, s := range selections {
+		record.Mirrors = append(record.Mirrors, s.Mirror.Name)
+		record.Reasons = append(record.Reasons, s.Reason)
+	}
+
+	data, err := json.Marshal(&record)
+	if err != nil {
+		common.ErrorPrintf("Failed to marshal selection record: %v\n", err)
+		return
+	}
+	if _, err := lf.Write(append(data, '\n')); err != nil {
+		common.ErrorPrintf("Failed to write selection log: %v\n", err)
+	}
+}
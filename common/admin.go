@@ -0,0 +1,166 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Administrative states of a mirror
+const (
+	// Neither selected nor checked
+	AdminDisabled		= "disabled"
+	// Not selected, but still checked without notifications
+	AdminMaintenance	= "maintenance"
+)
+
+// Administrative state of a mirror, set via the admin API.
+type AdminState struct {
+	State	string     `json:"state"`
+	Reason	string     `json:"reason,omitempty"`
+	Since	time.Time  `json:"since"`
+	Until	*time.Time `json:"until,omitempty"`  // nil if no expiry
+}
+
+// Protect the administrative states of the mirrors and the state file.
+var adminMu sync.RWMutex
+
+
+// Whether the state has expired at the time.
+//
+func (a *AdminState) Expired(now time.Time) bool {
+	return a.Until != nil && !now.Before(*a.Until)
+}
+
+// Get the active administrative state of the mirror, or nil if none.
+//
+func (m *Mirror) AdminState(now time.Time) *AdminState {
+	adminMu.RLock()
+	defer adminMu.RUnlock()
+
+	a := m.Status.Admin
+	if a == nil || a.Expired(now) {
+		return nil
+	}
+	return a
+}
+
+// Get a copy of the mirror, taken while the administrative states are
+// locked, with its expired administrative state hidden.
+//
+func (m *Mirror) Snapshot(now time.Time) *Mirror {
+	adminMu.RLock()
+	defer adminMu.RUnlock()
+
+	c := *m
+	if a := c.Status.Admin; a != nil && a.Expired(now) {
+		c.Status.Admin = nil
+	}
+	return &c
+}
+
+// Set the administrative state of the mirror, or clear it if nil, and
+// save the states to the state file (if configured).  The expired states
+// of all mirrors are also cleared.  The previous state is kept if the
+// states fail to be saved.
+//
+func SetAdminState(name string, state *AdminState) error {
+	mirror, ok := AppConfig.Mirrors[name]
+	if !ok {
+		return fmt.Errorf("Unknown mirror: %s", name)
+	}
+	if state != nil && state.State != AdminDisabled &&
+	   state.State != AdminMaintenance {
+		return fmt.Errorf("Invalid state: %s", state.State)
+	}
+
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	prev := mirror.Status.Admin
+	mirror.Status.Admin = state
+	expireAdminStates(time.Now())
+	if err := saveAdminStates(); err != nil {
+		mirror.Status.Admin = prev
+		return err
+	}
+	return nil
+}
+
+// Clear the expired administrative states.
+//
+// NOTE: adminMu must be held.
+//
+func expireAdminStates(now time.Time) {
+	for name, mirror := range AppConfig.Mirrors {
+		if a := mirror.Status.Admin; a != nil && a.Expired(now) {
+			InfoPrintf("Mirror [%s] %s state expired.\n", name, a.State)
+			mirror.Status.Admin = nil
+		}
+	}
+}
+
+
+// Load the administrative states from the state file, skipping the
+// expired ones and the ones of unknown mirrors.
+//
+func loadAdminStates() {
+	fname := AppConfig.Admin.StateFile
+	if fname == "" {
+		return
+	}
+	data, err := os.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		Fatalf("Failed to read admin state file: %v\n", err)
+	}
+
+	var states map[string]*AdminState
+	if err := json.Unmarshal(data, &states); err != nil {
+		Fatalf("Failed to parse admin state file (%s): %v\n", fname, err)
+	}
+
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	now := time.Now()
+	for name, state := range states {
+		mirror, ok := AppConfig.Mirrors[name]
+		if !ok {
+			WarnPrintf("Admin state of unknown mirror [%s] dropped.\n",
+					name)
+			continue
+		}
+		if state == nil || state.Expired(now) {
+			continue
+		}
+		mirror.Status.Admin = state
+		InfoPrintf("Mirror [%s] in %s state: %s\n",
+				name, state.State, state.Reason)
+	}
+}
+
+// Save the administrative states to the state file, if configured.
+//
+// NOTE: adminMu must be held.
+//
+func saveAdminStates() error {
+	fname := AppConfig.Admin.StateFile
+	if fname == "" {
+		return nil
+	}
+
+	states := map[string]*AdminState{}
+	for name, mirror := range AppConfig.Mirrors {
+		if mirror.Status.Admin != nil {
+			states[name] = mirror.Status.Admin
+		}
+	}
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(fname, append(data, '\n'))
+}
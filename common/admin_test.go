@@ -0,0 +1,84 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+
+func TestAdminState(t *testing.T) {
+	ReadConfig("../testdata/mirrorselect.toml")
+	fname := filepath.Join(t.TempDir(), "admin.json")
+	AppConfig.Admin.StateFile = fname
+	defer func() { AppConfig.Admin.StateFile = "" }()
+
+	now := time.Now()
+	until := now.Add(time.Hour)
+	mirror := AppConfig.Mirrors["sjtug"]
+	err := SetAdminState("sjtug", &AdminState{
+		State: AdminMaintenance,
+		Reason: "disk replacement",
+		Since: now,
+		Until: &until,
+	})
+	if err != nil {
+		t.Fatalf("SetAdminState() failed: %v", err)
+	}
+	if a := mirror.AdminState(now); a == nil || a.State != AdminMaintenance {
+		t.Errorf("AdminState() = %+v, want maintenance", a)
+	}
+	if a := mirror.AdminState(until); a != nil {
+		t.Errorf("AdminState() = %+v after expiry, want nil", a)
+	}
+
+	if err := SetAdminState("nonexist", &AdminState{
+		State: AdminDisabled,
+	}); err == nil {
+		t.Errorf("SetAdminState(nonexist) succeeded, want error")
+	}
+	if err := SetAdminState("sjtug", &AdminState{
+		State: "offline",
+	}); err == nil {
+		t.Errorf("SetAdminState(offline) succeeded, want error")
+	}
+
+	// Persisted across restarts
+	mirror.Status.Admin = nil
+	loadAdminStates()
+	if a := mirror.AdminState(now); a == nil || a.Reason != "disk replacement" {
+		t.Errorf("loadAdminStates() failed: state = %+v", a)
+	}
+
+	// Expired states are cleared upon the next change.
+	past := now.Add(-time.Minute)
+	mirror.Status.Admin.Until = &past
+	if err := SetAdminState("dfly_avalon", nil); err != nil {
+		t.Fatalf("SetAdminState(dfly_avalon, nil) failed: %v", err)
+	}
+	if mirror.Status.Admin != nil {
+		t.Errorf("SetAdminState() failed: expired state = %+v",
+				mirror.Status.Admin)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil || string(data) != "{}\n" {
+		t.Errorf("SetAdminState() failed: state file = %q (%v)",
+				data, err)
+	}
+
+	// The previous state is kept if the state file cannot be written.
+	AppConfig.Admin.StateFile = filepath.Join(t.TempDir(),
+			"nonexist", "admin.json")
+	err = SetAdminState("sjtug", &AdminState{
+		State: AdminDisabled,
+		Since: now,
+	})
+	if err == nil {
+		t.Errorf("SetAdminState() succeeded with unwritable state file")
+	}
+	if mirror.Status.Admin != nil {
+		t.Errorf("SetAdminState() failed: state = %+v after error, " +
+				"want nil", mirror.Status.Admin)
+	}
+}
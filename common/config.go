@@ -1,58 +1,247 @@
 package common
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"net/url"
+	"os"
 	"path/filepath"
+	"regexp"
 	"time"
 	"strings"
+	"sync"
 
 	"github.com/oschwald/maxminddb-golang"
 	"github.com/spf13/viper"
 )
 
+// Details of a certificate in the chain presented by a server.
+type CertInfo struct {
+	Subject		string    `json:"subject"`
+	Issuer		string    `json:"issuer"`
+	NotAfter	time.Time `json:"not_after"`
+	DNSNames	[]string  `json:"dns_names,omitempty"`
+}
+
+// Certificate status of an HTTPS URL.
+type CertStatus struct {
+	Chain		[]CertInfo `json:"chain"`  // leaf first
+	// Earliest expiry of the chain
+	NotAfter	time.Time  `json:"not_after"`
+	Expiring	bool       `json:"expiring"`  // within the warning window
+	Error		string     `json:"error,omitempty"`  // of the last check
+	Warned		time.Time  `json:"-"`  // last expiry warning logged
+}
+
+// Status of a URL of a mirror.
+type URLStatus struct {
+	Online		bool    `json:"online"`  // over IPv4 or IPv6
+	Online4		bool    `json:"online4"`
+	Online6		bool    `json:"online6"`
+	Hysteresis	int     `json:"hysteresis"`
+	Hysteresis4	int     `json:"hysteresis4"`
+	Hysteresis6	int     `json:"hysteresis6"`
+	Error		string  `json:"error,omitempty"`  // of the last check
+	Cert		*CertStatus `json:"cert,omitempty"`  // HTTPS only
+}
+
 type MirrorStatus struct {
-	Online		bool    `json:"online"`
+	Online		bool    `json:"online"`  // over IPv4 or IPv6
+	Online4		bool    `json:"online4"`
+	Online6		bool    `json:"online6"`
 	OKCount		int     `json:"ok_count"`
 	ErrorCount	int     `json:"error_count"`
 	Hysteresis	int     `json:"hysteresis"`
+	Hysteresis4	int     `json:"hysteresis4"`
+	Hysteresis6	int     `json:"hysteresis6"`
+	Latency		int64   `json:"latency_ms"`  // of the last OK check
+	// Download throughput (bytes per second) of the last probe; 0 if
+	// unknown
+	Throughput	int64   `json:"throughput"`
+	ThroughputTime	time.Time `json:"throughput_time"`
+	NextCheck	time.Time `json:"next_check"`
+	// Whether the state changes too often (see FlapRate)
+	Flapping	bool    `json:"flapping"`
+	FlapRate	float64 `json:"flap_rate"`  // percent
+	History		[]bool  `json:"-"`  // recent check results
+	// Warning state: a certificate of the HTTPS URLs expiring soon
+	CertExpiring	bool    `json:"cert_expiring"`
+	// Status of each URL (the main and additional ones)
+	URLs		map[string]*URLStatus `json:"urls,omitempty"`
+	// Administrative state set via the admin API, if any
+	Admin		*AdminState `json:"admin,omitempty"`
 }
 
 type Mirror struct {
 	Name		string  `mapstructure:"name" json:"name"`
 	IsDefault	bool    `mapstructure:"default" json:"default"`
 	URL		string  `mapstructure:"url" json:"url"`
+	// Additional URLs: alternative HTTP(S)/FTP URLs to serve packages,
+	// or other endpoints to monitor (e.g., rsync://, tcp://host:port)
+	URLs		[]string `mapstructure:"urls" json:"urls,omitempty"`
 	ContinentCode	string  `mapstructure:"continent_code" json:"continent_code"`
 	CountryCode	string  `mapstructure:"country_code" json:"country_code"`
 	Latitude	float64 `mapstructure:"latitude" json:"latitude"`
 	Longitude	float64 `mapstructure:"longitude" json:"longitude"`
+	ASN		[]uint  `mapstructure:"asn" json:"asn,omitempty"`
+	Weight		int     `mapstructure:"weight" json:"weight"`
+	// Monitor settings overriding the global [monitor] ones
+	Monitor		MirrorMonitorConfig `mapstructure:"monitor" json:"-"`
+	// Effective monitor settings
+	Check		*CheckConfig `mapstructure:"-" json:"-"`
 	Status		MirrorStatus `json:"status"`
 }
 
+// Per-mirror monitor settings; the unset ones inherit from [monitor].
+type MirrorMonitorConfig struct {
+	Interval	time.Duration     `mapstructure:"interval"`
+	Timeout		time.Duration     `mapstructure:"timeout"`
+	Path		string            `mapstructure:"path"`
+	TLSVerify	*bool             `mapstructure:"tls_verify"`
+	StatusCodes	[]int             `mapstructure:"status_codes"`
+	Headers		map[string]string `mapstructure:"headers"`
+	Expect		string            `mapstructure:"expect"`
+	ExpectRegex	string            `mapstructure:"expect_regex"`
+	ExpectSHA256	string            `mapstructure:"expect_sha256"`
+	MaxBytes	int64             `mapstructure:"max_bytes"`
+}
+
+// Monitor settings to check a mirror, merged from the global and the
+// per-mirror ones.
+type CheckConfig struct {
+	Interval	time.Duration
+	Timeout		time.Duration
+	Path		string  // relative to the HTTP(S)/FTP URLs
+	TLSVerify	bool
+	StatusCodes	[]int
+	Headers		map[string]string
+	// Expected content of the checked path, if any
+	Expect		string  // substring
+	ExpectRegex	string
+	ExpectRe	*regexp.Regexp  // compiled ExpectRegex, by Validate()
+	ExpectSHA256	string
+	MaxBytes	int64   // max bytes to read for the content checks
+}
+
 type MMDBConfig struct {
-	Type		int
-	DB		*maxminddb.Reader
+	TypeName	string `mapstructure:"type"`
+	File		string `mapstructure:"file"`
+	Family		string `mapstructure:"family"`
+	TestIP		string `mapstructure:"test_ip"`
+	Edition		string `mapstructure:"edition"`
+	LicenseKey	string `mapstructure:"license_key"`
+	UpdateURL	string `mapstructure:"update_url"`
+	Type		int               `mapstructure:"-"`
+	IsASN		bool              `mapstructure:"-"`
+	DB		*maxminddb.Reader `mapstructure:"-"`
+
+	mu		sync.RWMutex  // protect DB against reloading
+	fileInfo	os.FileInfo
+}
+
+// Override the location and/or preferred mirrors of client networks.
+type OverrideConfig struct {
+	Networks	[]string `mapstructure:"networks"`
+	ContinentCode	string   `mapstructure:"continent_code"`
+	CountryCode	string   `mapstructure:"country_code"`
+	Latitude	float64  `mapstructure:"latitude"`
+	Longitude	float64  `mapstructure:"longitude"`
+	Mirrors		[]string `mapstructure:"mirrors"`
+}
+
+// Group countries into a region for the region selection tier.
+type RegionConfig struct {
+	Name		string   `mapstructure:"name"`
+	Countries	[]string `mapstructure:"countries"`
+}
+
+type UpdateConfig struct {
+	Enabled		bool          `mapstructure:"enabled"`
+	Interval	time.Duration `mapstructure:"interval"`
+	Timeout		time.Duration `mapstructure:"timeout"`
 }
 
 type MonitorConfig struct {
 	Workers		int           `mapstructure:"workers"`
 	Interval	time.Duration `mapstructure:"interval"`
+	RetryInterval	time.Duration `mapstructure:"retry_interval"`
+	MaxInterval	time.Duration `mapstructure:"max_interval"`
+	Jitter		float64       `mapstructure:"jitter"`
 	Timeout		time.Duration `mapstructure:"timeout"`
 	Hysteresis	int           `mapstructure:"hysteresis"`
+	FlapWindow	int           `mapstructure:"flap_window"`
+	FlapHigh	float64       `mapstructure:"flap_high"`
+	FlapLow		float64       `mapstructure:"flap_low"`
+	FlapDemote	bool          `mapstructure:"flap_demote"`
+	FlapNotify	bool          `mapstructure:"flap_notify"`
+	Families	[]string      `mapstructure:"families"`
+	Path		string        `mapstructure:"path"`
 	TLSVerify	bool          `mapstructure:"tls_verify"`
+	StatusCodes	[]int         `mapstructure:"status_codes"`
+	Headers		map[string]string `mapstructure:"headers"`
+	Expect		string        `mapstructure:"expect"`
+	ExpectRegex	string        `mapstructure:"expect_regex"`
+	ExpectSHA256	string        `mapstructure:"expect_sha256"`
+	MaxBytes	int64         `mapstructure:"max_bytes"`
+	CertWarning	int           `mapstructure:"cert_warning"`  // days
+	ThroughputPath	string        `mapstructure:"throughput_path"`
+	ThroughputInterval time.Duration `mapstructure:"throughput_interval"`
+	ThroughputBytes	int64         `mapstructure:"throughput_bytes"`
+	ThroughputTimeout time.Duration `mapstructure:"throughput_timeout"`
 	UserAgent	string        `mapstructure:"user_agent"`
 	NotifyExec	string        `mapstructure:"notify_exec"`
 	ExecTimeout	time.Duration `mapstructure:"exec_timeout"`
 }
 
+type AdminConfig struct {
+	Token		string `mapstructure:"token"`
+	StateFile	string `mapstructure:"state_file"`
+}
+
+type LogConfig struct {
+	Level		string `mapstructure:"level"`
+	Format		string `mapstructure:"format"`
+	Output		string `mapstructure:"output"`
+	SyslogFacility	string `mapstructure:"syslog_facility"`
+	SyslogTag	string `mapstructure:"syslog_tag"`
+	SelectionLog	string `mapstructure:"selection_log"`
+	Selection	*LogFile
+}
+
+type PrivacyConfig struct {
+	AnonymizeIP	bool   `mapstructure:"anonymize_ip"`
+	IPv4Prefix	int    `mapstructure:"ipv4_prefix"`
+	IPv6Prefix	int    `mapstructure:"ipv6_prefix"`
+}
+
 type Config struct {
 	Debug		bool   `mapstructure:"debug"`
 	Listen		string `mapstructure:"listen"`
 	MirrorListFile	string `mapstructure:"mirror_list"`
 	Mirrors		map[string]*Mirror
+	// Ordered fallback mirrors used before the default one
+	FallbackMirrors	[]string  `mapstructure:"fallback_mirrors"`
+	Fallbacks	[]*Mirror `mapstructure:"-"`
 	MMDBType	string `mapstructure:"mmdb_type"`
 	MMDBFile	string `mapstructure:"mmdb_file"`
-	MMDB		MMDBConfig
+	MMDB		[]*MMDBConfig `mapstructure:"mmdb"`
+	ASNMMDB		*MMDBConfig   `mapstructure:"asn_mmdb"`
+	MMDBCheckInterval time.Duration `mapstructure:"mmdb_check_interval"`
+	MMDBUpdate	UpdateConfig  `mapstructure:"mmdb_update"`
+	Overrides	[]*OverrideConfig `mapstructure:"override"`
+	Selector	string   `mapstructure:"selector"`
+	URLSchemes	[]string `mapstructure:"url_schemes"`
+	MinMirrors	int      `mapstructure:"min_mirrors"`
+	MaxMirrors	int      `mapstructure:"max_mirrors"`
+	Tiers		[]string `mapstructure:"tiers"`
+	// Max number of the nearest mirrors taken by the world tier
+	WorldMirrors	int      `mapstructure:"world_mirrors"`
+	Regions		[]*RegionConfig `mapstructure:"region"`
 	Monitor		MonitorConfig
+	Admin		AdminConfig
+	Log		LogConfig
+	Privacy		PrivacyConfig
 }
 
 const (
@@ -72,11 +261,45 @@ func resetConfig() {
 	v := viper.New()
 	v.SetDefault("debug", false)
 	v.SetDefault("listen", "127.0.0.1:3130")
+	v.SetDefault("log.level", "info")
+	v.SetDefault("log.format", "text")
+	v.SetDefault("log.syslog_facility", "daemon")
+	v.SetDefault("log.syslog_tag", AppName)
+	v.SetDefault("selector", "tier")
+	v.SetDefault("url_schemes", []string{ "https", "http", "ftp" })
+	v.SetDefault("min_mirrors", 0)
+	v.SetDefault("max_mirrors", 0)  // unlimited
+	v.SetDefault("tiers", []string{
+		"asn", "country", "region", "subregion", "continent", "world",
+	})
+	v.SetDefault("world_mirrors", 3)
+	v.SetDefault("mmdb_check_interval", 60)
+	v.SetDefault("mmdb_update.enabled", false)
+	v.SetDefault("mmdb_update.interval", 86400)  // daily
+	v.SetDefault("mmdb_update.timeout", 600)
+	v.SetDefault("privacy.anonymize_ip", false)
+	v.SetDefault("privacy.ipv4_prefix", 24)
+	v.SetDefault("privacy.ipv6_prefix", 48)
 	v.SetDefault("monitor.workers", 10)
 	v.SetDefault("monitor.interval", 3600)  // hourly
+	v.SetDefault("monitor.retry_interval", 60)
+	v.SetDefault("monitor.max_interval", 6 * 3600)
+	v.SetDefault("monitor.jitter", 0.1)
 	v.SetDefault("monitor.timeout", 5)
 	v.SetDefault("monitor.hysteresis", 3)
+	v.SetDefault("monitor.flap_window", 21)
+	v.SetDefault("monitor.flap_high", 50.0)
+	v.SetDefault("monitor.flap_low", 25.0)
+	v.SetDefault("monitor.flap_demote", false)
+	v.SetDefault("monitor.flap_notify", false)
+	v.SetDefault("monitor.families", []string{ "ipv4", "ipv6" })
 	v.SetDefault("monitor.tls_verify", true)
+	v.SetDefault("monitor.status_codes", []int{ 200 })
+	v.SetDefault("monitor.max_bytes", 1 << 20)
+	v.SetDefault("monitor.cert_warning", 14)
+	v.SetDefault("monitor.throughput_interval", 86400)  // daily
+	v.SetDefault("monitor.throughput_bytes", 8 << 20)
+	v.SetDefault("monitor.throughput_timeout", 60)
 	v.SetDefault("monitor.user_agent", AppName+"/"+Version)
 	v.SetDefault("monitor.exec_timeout", 3)
 
@@ -97,17 +320,117 @@ func ReadConfig(cfgfile string) *Config {
 	if err != nil {
 		Fatalf("Failed to read config: %v\n", err)
 	}
-	InfoPrintf("Read in config file.\n")
 
+	// Lists are not merged with the previous config
+	AppConfig.MMDB = nil
+	AppConfig.ASNMMDB = nil
+	AppConfig.Overrides = nil
+	AppConfig.FallbackMirrors = nil
+	AppConfig.Regions = nil
+	if v.IsSet("tiers") {
+		AppConfig.Tiers = nil
+	}
+	if v.IsSet("url_schemes") {
+		AppConfig.URLSchemes = nil
+	}
+	if v.IsSet("monitor.families") {
+		AppConfig.Monitor.Families = nil
+	}
+	if v.IsSet("monitor.status_codes") {
+		AppConfig.Monitor.StatusCodes = nil
+	}
+	AppConfig.Monitor.Headers = nil
 	err = v.Unmarshal(AppConfig)
 	if err != nil {
 		Fatalf("Failed to unmarshal config: %v\n", err)
 	}
 
+	err = setupLogger(&AppConfig.Log, AppConfig.Debug)
+	if err != nil {
+		Fatalf("Failed to setup logger: %v\n", err)
+	}
+	InfoPrintf("Read in config file.\n")
+
+	if AppConfig.Log.SelectionLog != "" {
+		AppConfig.Log.Selection, err = OpenLogFile(AppConfig.Log.SelectionLog)
+		if err != nil {
+			Fatalf("Failed to open selection log: %v\n", err)
+		}
+		InfoPrintf("Write selection log to file: %s\n",
+				AppConfig.Log.SelectionLog)
+	}
+
 	if AppConfig.Monitor.Workers <= 0 {
 		Fatalf("Config [monitor.workers] = %d <= 0\n",
 				AppConfig.Monitor.Workers)
 	}
+	if AppConfig.Monitor.RetryInterval <= 0 {
+		Fatalf("Config [monitor.retry_interval] = %d <= 0\n",
+				AppConfig.Monitor.RetryInterval)
+	}
+	if j := AppConfig.Monitor.Jitter; j < 0 || j >= 1 {
+		Fatalf("Config [monitor.jitter] = %v not in [0, 1)\n", j)
+	}
+	if AppConfig.Monitor.FlapWindow < 0 {
+		Fatalf("Config [monitor.flap_window] = %d < 0\n",
+				AppConfig.Monitor.FlapWindow)
+	}
+	if low, high := AppConfig.Monitor.FlapLow, AppConfig.Monitor.FlapHigh;
+	   low < 0 || low > high || high > 100 {
+		Fatalf("Config [monitor.flap_low/flap_high] = %v/%v invalid\n",
+				low, high)
+	}
+	if AppConfig.Monitor.ThroughputPath != "" &&
+	   (AppConfig.Monitor.ThroughputInterval <= 0 ||
+	    AppConfig.Monitor.ThroughputBytes <= 0 ||
+	    AppConfig.Monitor.ThroughputTimeout <= 0) {
+		Fatalf("Config [monitor.throughput_*] must be > 0\n")
+	}
+	if AppConfig.Monitor.CertWarning < 0 {
+		Fatalf("Config [monitor.cert_warning] = %d < 0\n",
+				AppConfig.Monitor.CertWarning)
+	}
+
+	if len(AppConfig.Monitor.StatusCodes) == 0 {
+		Fatalf("Config [monitor.status_codes] empty\n")
+	}
+
+	if len(AppConfig.Monitor.Families) == 0 {
+		Fatalf("Config [monitor.families] empty\n")
+	}
+	for i, family := range AppConfig.Monitor.Families {
+		family = strings.ToLower(family)
+		if family != "ipv4" && family != "ipv6" {
+			Fatalf("Config [monitor.families] invalid: %s\n", family)
+		}
+		AppConfig.Monitor.Families[i] = family
+	}
+
+	if len(AppConfig.URLSchemes) == 0 {
+		Fatalf("Config [url_schemes] empty\n")
+	}
+	for i, scheme := range AppConfig.URLSchemes {
+		scheme = strings.ToLower(scheme)
+		if !IsPkgScheme(scheme) {
+			Fatalf("Config [url_schemes] invalid: %s\n", scheme)
+		}
+		AppConfig.URLSchemes[i] = scheme
+	}
+
+	err = CheckMirrorLimits(AppConfig.MinMirrors, AppConfig.MaxMirrors)
+	if err != nil {
+		Fatalf("Config [min_mirrors]/[max_mirrors] invalid: %v\n", err)
+	}
+	if n := AppConfig.WorldMirrors; n < 0 {
+		Fatalf("Config [world_mirrors] = %d negative\n", n)
+	}
+
+	if p := AppConfig.Privacy.IPv4Prefix; p < 0 || p > 32 {
+		Fatalf("Config [privacy.ipv4_prefix] = %d not in [0, 32]\n", p)
+	}
+	if p := AppConfig.Privacy.IPv6Prefix; p < 0 || p > 128 {
+		Fatalf("Config [privacy.ipv6_prefix] = %d not in [0, 128]\n", p)
+	}
 
 	if !AppConfig.Monitor.TLSVerify {
 		WarnPrintf("TLS verification disabled! THIS IS INSECURE!!!")
@@ -121,30 +444,196 @@ func ReadConfig(cfgfile string) *Config {
 		mlfile = filepath.Join(filepath.Dir(cfgfile), mlfile)
 	}
 	readMirrors(mlfile)
+	setupFallbacks()
+
+	if AppConfig.Admin.Token != "" && len(AppConfig.Admin.Token) < 16 {
+		Fatalf("Config [admin.token] too short (< 16 characters)\n")
+	}
+	if sf := AppConfig.Admin.StateFile; sf != "" && !filepath.IsAbs(sf) {
+		AppConfig.Admin.StateFile = filepath.Join(filepath.Dir(cfgfile), sf)
+	}
+	loadAdminStates()
+
+	readMMDBs(cfgfile)
+
+	// Keep the secret token out of the log.
+	dump := *AppConfig
+	if dump.Admin.Token != "" {
+		dump.Admin.Token = "REDACTED"
+	}
+	DebugPrintf("App config: %+v\n", &dump)
+	return AppConfig
+}
 
-	switch strings.ToLower(AppConfig.MMDBType) {
-	case "db-ip", "dbip":
-		AppConfig.MMDB.Type = MMDB_DBIP
-	case "maxmind":
-		AppConfig.MMDB.Type = MMDB_MAXMIND
+// Whether pkg(8) can fetch packages from the URL scheme.
+//
+func IsPkgScheme(scheme string) bool {
+	switch scheme {
+	case "http", "https", "ftp":
+		return true
 	default:
-		Fatalf("Config [mmdb_type] invalid: %v", AppConfig.MMDBType)
+		return false
 	}
+}
 
-	mmdbfile := AppConfig.MMDBFile
-	if mmdbfile == "" {
-		Fatalf("Config [mmdb_file] not set")
+// Some mirrors may return 404 if there is no trailing slash.
+//
+func normalizeURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err == nil && IsPkgScheme(u.Scheme) &&
+	   !strings.HasSuffix(rawurl, "/") {
+		rawurl += "/"
 	}
-	if !filepath.IsAbs(mmdbfile) {
-		mmdbfile = filepath.Join(filepath.Dir(cfgfile), mmdbfile)
+	return rawurl
+}
+
+// Get the main URL followed by the additional URLs of the mirror.
+//
+func (m *Mirror) AllURLs() []string {
+	return append([]string{ m.URL }, m.URLs...)
+}
+
+// Get the URLs that pkg(8) can fetch packages from, i.e., the main URL
+// followed by the additional HTTP(S)/FTP URLs.
+//
+func (m *Mirror) PkgURLs() []string {
+	urls := []string{ m.URL }
+	for _, rawurl := range m.URLs {
+		u, err := url.Parse(rawurl)
+		if err == nil && IsPkgScheme(u.Scheme) {
+			urls = append(urls, rawurl)
+		}
 	}
-	AppConfig.MMDB.DB, err = maxminddb.Open(mmdbfile)
-	if err != nil {
-		Fatalf("Failed to open MMDB: %v\n", err)
+	return urls
+}
+
+// Merge the per-mirror monitor settings (if any) over the global ones.
+//
+func (mc *MonitorConfig) CheckConfig(o *MirrorMonitorConfig) *CheckConfig {
+	cc := &CheckConfig{
+		Interval: mc.Interval * time.Second,
+		Timeout: mc.Timeout * time.Second,
+		Path: mc.Path,
+		TLSVerify: mc.TLSVerify,
+		StatusCodes: mc.StatusCodes,
+		Headers: map[string]string{},
+		Expect: mc.Expect,
+		ExpectRegex: mc.ExpectRegex,
+		ExpectSHA256: strings.ToLower(mc.ExpectSHA256),
+		MaxBytes: mc.MaxBytes,
+	}
+	for k, v := range mc.Headers {
+		cc.Headers[k] = v
+	}
+	if o == nil {
+		return cc
 	}
 
-	DebugPrintf("App config: %+v\n", AppConfig)
-	return AppConfig
+	if o.Interval != 0 {
+		cc.Interval = o.Interval * time.Second
+	}
+	if o.Timeout != 0 {
+		cc.Timeout = o.Timeout * time.Second
+	}
+	if o.Path != "" {
+		cc.Path = o.Path
+	}
+	if o.TLSVerify != nil {
+		cc.TLSVerify = *o.TLSVerify
+	}
+	if len(o.StatusCodes) > 0 {
+		cc.StatusCodes = o.StatusCodes
+	}
+	for k, v := range o.Headers {
+		cc.Headers[k] = v
+	}
+	if o.Expect != "" {
+		cc.Expect = o.Expect
+	}
+	if o.ExpectRegex != "" {
+		cc.ExpectRegex = o.ExpectRegex
+	}
+	if o.ExpectSHA256 != "" {
+		cc.ExpectSHA256 = strings.ToLower(o.ExpectSHA256)
+	}
+	if o.MaxBytes != 0 {
+		cc.MaxBytes = o.MaxBytes
+	}
+	return cc
+}
+
+// Validate the monitor settings, and compile the expected regex once for
+// all the checks.
+//
+func (cc *CheckConfig) Validate() error {
+	if cc.Interval <= 0 {
+		return fmt.Errorf("interval = %v <= 0", cc.Interval)
+	}
+	if cc.Timeout <= 0 {
+		return fmt.Errorf("timeout = %v <= 0", cc.Timeout)
+	}
+	if cc.MaxBytes <= 0 {
+		return fmt.Errorf("max_bytes = %d <= 0", cc.MaxBytes)
+	}
+	if cc.ExpectRegex != "" {
+		re, err := regexp.Compile(cc.ExpectRegex)
+		if err != nil {
+			return fmt.Errorf("expect_regex invalid: %v", err)
+		}
+		cc.ExpectRe = re
+	}
+	if cc.ExpectSHA256 != "" {
+		b, err := hex.DecodeString(cc.ExpectSHA256)
+		if err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("expect_sha256 invalid: %s",
+					cc.ExpectSHA256)
+		}
+	}
+	return nil
+}
+
+// Whether to check the content of the checked path.
+//
+func (cc *CheckConfig) HasContentChecks() bool {
+	return cc.Expect != "" || cc.ExpectRegex != "" || cc.ExpectSHA256 != ""
+}
+
+
+// Resolve the [fallback_mirrors] names to the mirrors.
+//
+func setupFallbacks() {
+	AppConfig.Fallbacks = nil
+	for _, name := range AppConfig.FallbackMirrors {
+		mirror, ok := AppConfig.Mirrors[name]
+		if !ok {
+			Fatalf("Config [fallback_mirrors]: unknown mirror: %s\n",
+					name)
+		}
+		if mirror.IsDefault {
+			Fatalf("Config [fallback_mirrors]: %s is the default " +
+					"mirror\n", name)
+		}
+		AppConfig.Fallbacks = append(AppConfig.Fallbacks, mirror)
+	}
+	if n := len(AppConfig.Fallbacks); n > 0 {
+		InfoPrintf("Fallback mirrors: %v\n", AppConfig.FallbackMirrors)
+	}
+}
+
+// Check the limits on the number of returned mirrors (including the
+// default one); 0 means no limit.
+//
+func CheckMirrorLimits(min, max int) error {
+	if min < 0 {
+		return fmt.Errorf("minimum (%d) < 0", min)
+	}
+	if max < 0 {
+		return fmt.Errorf("maximum (%d) < 0", max)
+	}
+	if max > 0 && min > max {
+		return fmt.Errorf("minimum (%d) > maximum (%d)", min, max)
+	}
+	return nil
 }
 
 // Read config file of mirrors.
@@ -165,30 +654,53 @@ func readMirrors(fname string) {
 
 	var defaults []string
 	for name, mirror := range AppConfig.Mirrors {
-		// Some mirrors may return 404 if there is no trailing slash.
-		if !strings.HasSuffix(mirror.URL, "/") {
-			mirror.URL += "/"
-		}
-
+		mirror.URL = normalizeURL(mirror.URL)
 		u, err := url.Parse(mirror.URL)
 		if err != nil {
 			Fatalf("Mirror [%s] URL invalid: %v\n",
 					name, mirror.URL)
 		}
-		switch u.Scheme {
-		case "http", "https", "ftp":
-			break
-		default:
+		if !IsPkgScheme(u.Scheme) {
 			Fatalf("Mirror [%s] URL unsupported: %v\n",
 					name, mirror.URL)
 		}
+		for i, rawurl := range mirror.URLs {
+			mirror.URLs[i] = normalizeURL(rawurl)
+		}
 
 		if mirror.ContinentCode == "" || mirror.CountryCode == "" ||
 		   mirror.Latitude == 0 || mirror.Longitude == 0 {
 			Fatalf("Mirror [%s] location incomplete\n", name)
 		}
 
+		if mirror.Weight == 0 {
+			mirror.Weight = 1
+		} else if mirror.Weight < 0 {
+			Fatalf("Mirror [%s] weight = %d < 0\n",
+					name, mirror.Weight)
+		}
+
+		mirror.Check = AppConfig.Monitor.CheckConfig(&mirror.Monitor)
+		if err := mirror.Check.Validate(); err != nil {
+			Fatalf("Mirror [%s] monitor config: %v\n", name, err)
+		}
+
 		mirror.Status.Online = true
+		mirror.Status.Online4 = true
+		mirror.Status.Online6 = true
+
+		mirror.Status.URLs = map[string]*URLStatus{}
+		for _, rawurl := range mirror.AllURLs() {
+			if _, err := url.Parse(rawurl); err != nil {
+				Fatalf("Mirror [%s] URL invalid: %v\n",
+						name, rawurl)
+			}
+			mirror.Status.URLs[rawurl] = &URLStatus{
+				Online: true,
+				Online4: true,
+				Online6: true,
+			}
+		}
 		DebugPrintf("Mirror [%s]: %+v\n", name, mirror)
 
 		if mirror.IsDefault {
@@ -204,3 +716,4 @@ func readMirrors(fname string) {
 		Fatalf("More than one default mirrors: %v", defaults)
 	}
 }
+
@@ -1,6 +1,9 @@
 package common
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 
 func TestReadConfig(t *testing.T) {
@@ -23,6 +26,25 @@ func TestReadConfig(t *testing.T) {
 					fname, name)
 		}
 	}
+
+	check := cfg.Mirrors["dfly_avalon"].Check
+	if check.Timeout != 20 * time.Second || !check.TLSVerify ||
+	   len(check.StatusCodes) != 2 ||
+	   check.Headers["x-mirror-check"] != "mirrorselect" {
+		t.Errorf("ReadConfig(%q) failed: mirror [dfly_avalon] check = %+v\n",
+				fname, check)
+	}
+	check = cfg.Mirrors["sjtug"].Check
+	if check.Timeout != cfg.Monitor.Timeout * time.Second ||
+	   check.TLSVerify || len(check.StatusCodes) != 1 {
+		t.Errorf("ReadConfig(%q) failed: mirror [sjtug] check = %+v\n",
+				fname, check)
+	}
+
+	if len(cfg.Fallbacks) != 1 || cfg.Fallbacks[0] != cfg.Mirrors["dfly_avalon"] {
+		t.Errorf("ReadConfig(%q) failed: fallbacks = %v, want [dfly_avalon]\n",
+				fname, cfg.Fallbacks)
+	}
 }
 
 
@@ -34,3 +56,64 @@ func TestResetConfig(t *testing.T) {
 				AppConfig.Monitor.TLSVerify)
 	}
 }
+
+
+func TestCheckMirrorLimits(t *testing.T) {
+	cases := []struct {
+		min, max int
+		ok bool
+	}{
+		{ 0, 0, true },
+		{ 3, 0, true },
+		{ 0, 3, true },
+		{ 3, 3, true },
+		{ 4, 3, false },
+		{ -1, 0, false },
+		{ 0, -1, false },
+	}
+	for _, tc := range cases {
+		err := CheckMirrorLimits(tc.min, tc.max)
+		if (err == nil) != tc.ok {
+			t.Errorf("CheckMirrorLimits(%d, %d) = %v, want ok = %v",
+					tc.min, tc.max, err, tc.ok)
+		}
+	}
+}
+
+
+func TestCheckConfigValidate(t *testing.T) {
+	valid := func() *CheckConfig {
+		return &CheckConfig{
+			Interval: time.Hour,
+			Timeout: time.Second,
+			MaxBytes: 1024,
+		}
+	}
+	cases := []struct {
+		modify func(cc *CheckConfig)
+		ok bool
+	}{
+		{ func(cc *CheckConfig) {}, true },
+		{ func(cc *CheckConfig) { cc.Timeout = 0 }, false },
+		{ func(cc *CheckConfig) { cc.MaxBytes = 0 }, false },
+		{ func(cc *CheckConfig) { cc.ExpectRegex = `^packsite` }, true },
+		{ func(cc *CheckConfig) { cc.ExpectRegex = `(` }, false },
+		{ func(cc *CheckConfig) {
+			cc.ExpectSHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+		}, true },
+		{ func(cc *CheckConfig) { cc.ExpectSHA256 = "e3b0c442" }, false },
+	}
+	for i, tc := range cases {
+		cc := valid()
+		tc.modify(cc)
+		err := cc.Validate()
+		if (err == nil) != tc.ok {
+			t.Errorf("case %d: Validate(%+v) = %v, want ok = %v",
+					i, cc, err, tc.ok)
+		}
+		if err == nil && cc.ExpectRegex != "" && cc.ExpectRe == nil {
+			t.Errorf("case %d: Validate(%+v): regex not compiled",
+					i, cc)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+)
+
+
+// Write the data to a temporary file in the same directory and then
+// rename it to the path, so that readers never see a partial file.
+//
+func WriteFileAtomic(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+	f, err := os.CreateTemp(dir, "." + name + ".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)  // no-op after renamed
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
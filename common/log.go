@@ -1,30 +1,156 @@
 package common
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"log/syslog"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-var (
-	outLogger *log.Logger
-	errLogger *log.Logger
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelFatal
 )
 
+var levelNames = []string{ "DEBUG", "INFO", "WARNING", "ERROR", "FATAL" }
+
+// Structured fields attached to a log message.
+type Fields map[string]interface{}
+
+// A leveled logger writing either text or JSON lines.
+//
+type Logger struct {
+	level	int
+	json	bool
+	out	io.Writer  // for debug/info messages
+	err	io.Writer  // for warning/error/fatal messages
+	sys	*syslog.Writer
+	mu	sync.Mutex
+}
+
+// A log entry carrying structured fields.
+type Entry struct {
+	fields	Fields
+}
+
+var logger *Logger
+
+var syslogFacilities = map[string]syslog.Priority{
+	"daemon": syslog.LOG_DAEMON,
+	"user":   syslog.LOG_USER,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
 func init() {
-	flag := log.Ldate | log.Ltime
-	outLogger = log.New(os.Stdout, "", flag)
-	errLogger = log.New(os.Stderr, "", flag)
+	logger = &Logger{
+		level: LevelInfo,
+		out: os.Stdout,
+		err: os.Stderr,
+	}
+}
+
+// Parse the log level name.
+//
+func ParseLevel(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("Invalid log level: %s", name)
+	}
+}
+
+// Configure the logger according to the [log] config.
+//
+func setupLogger(cfg *LogConfig, debug bool) error {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	if debug {
+		level = LevelDebug
+	}
+
+	var isJSON bool
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		isJSON = false
+	case "json":
+		isJSON = true
+	default:
+		return fmt.Errorf("Invalid log format: %s", cfg.Format)
+	}
+
+	out, errw := io.Writer(os.Stdout), io.Writer(os.Stderr)
+	var sys *syslog.Writer
+	switch cfg.Output {
+	case "", "stdout":
+		break
+	case "stderr":
+		out = os.Stderr
+	case "syslog":
+		facility, ok := syslogFacilities[strings.ToLower(cfg.SyslogFacility)]
+		if !ok {
+			return fmt.Errorf("Invalid syslog facility: %s",
+					cfg.SyslogFacility)
+		}
+		tag := cfg.SyslogTag
+		if tag == "" {
+			tag = AppName
+		}
+		sys, err = syslog.New(facility|syslog.LOG_INFO, tag)
+		if err != nil {
+			return err
+		}
+	default:
+		f, err := OpenLogFile(cfg.Output)
+		if err != nil {
+			return err
+		}
+		out, errw = f, f
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if logger.sys != nil {
+		logger.sys.Close()
+	}
+	logger.level = level
+	logger.json = isJSON
+	logger.out = out
+	logger.err = errw
+	logger.sys = sys
+	return nil
 }
 
 // Get the file and function information of the logger caller.
 // Result: "file:line:function"
 func getOrigin() string {
-	// calldepth is 2: caller -> xxxPrintf() -> getOrigin()
-	pc, file, line, ok := runtime.Caller(2)
+	// calldepth is 3: caller -> xxxPrintf() -> logf() -> getOrigin()
+	pc, file, line, ok := runtime.Caller(3)
 	if !ok {
 		return "???:?:???"
 	}
@@ -34,31 +160,184 @@ func getOrigin() string {
 	return file + ":" + strconv.Itoa(line) + ":" + fn
 }
 
-func DebugPrintf(format string, v ...interface{}) {
-	if !AppConfig.Debug {
+// Format and write a message at the given level.
+//
+func logf(level int, fields Fields, format string, v ...interface{}) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if level < logger.level {
 		return
 	}
 
-	format = fmt.Sprintf("[DEBUG] %s: %s", getOrigin(), format)
-	errLogger.Printf(format, v...)
+	now := time.Now()
+	origin := getOrigin()
+	msg := strings.TrimSuffix(fmt.Sprintf(format, v...), "\n")
+
+	if logger.sys != nil {
+		writeSyslog(level, now, origin, msg, fields)
+		return
+	}
+
+	var line []byte
+	if logger.json {
+		line = formatJSON(now, level, origin, msg, fields)
+	} else {
+		line = formatText(now, level, origin, msg, fields)
+	}
+
+	w := logger.err
+	if level <= LevelInfo {
+		w = logger.out
+	}
+	w.Write(line)
+}
+
+// Send the message to syslog at the corresponding priority.
+// The timestamp is omitted from text messages since syslog adds one.
+//
+func writeSyslog(level int, t time.Time, origin, msg string, fields Fields) {
+	var text string
+	if logger.json {
+		text = string(formatJSON(t, level, origin, msg, fields))
+	} else {
+		text = formatBody(level, origin, msg, fields)
+	}
+
+	w := logger.sys
+	switch level {
+	case LevelDebug:
+		w.Debug(text)
+	case LevelInfo:
+		w.Info(text)
+	case LevelWarn:
+		w.Warning(text)
+	case LevelError:
+		w.Err(text)
+	default:
+		w.Crit(text)
+	}
+}
+
+// Format a text line: "date time [LEVEL] origin: message key=value ..."
+//
+func formatText(t time.Time, level int, origin, msg string,
+		fields Fields) []byte {
+	line := t.Format("2006/01/02 15:04:05") + " " +
+			formatBody(level, origin, msg, fields) + "\n"
+	return []byte(line)
+}
+
+// Format the text message without timestamp.
+//
+func formatBody(level int, origin, msg string, fields Fields) string {
+	var b strings.Builder
+	b.WriteString("[" + levelNames[level] + "] ")
+	b.WriteString(origin + ": " + msg)
+	for _, k := range sortedKeys(fields) {
+		s := fmt.Sprint(fieldValue(fields[k]))
+		if s == "" || strings.ContainsAny(s, " \t\"=") {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(" " + k + "=" + s)
+	}
+	return b.String()
+}
+
+// Format a JSON line; the fields cannot override the reserved keys.
+//
+func formatJSON(t time.Time, level int, origin, msg string,
+		fields Fields) []byte {
+	obj := make(map[string]interface{}, len(fields) + 4)
+	for k, v := range fields {
+		obj[k] = fieldValue(v)
+	}
+	obj["time"] = t.Format(time.RFC3339Nano)
+	obj["level"] = strings.ToLower(levelNames[level])
+	obj["origin"] = origin
+	obj["msg"] = msg
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		data, _ = json.Marshal(map[string]string{
+			"time": obj["time"].(string),
+			"level": obj["level"].(string),
+			"origin": origin,
+			"msg": msg,
+			"log_error": err.Error(),
+		})
+	}
+	return append(data, '\n')
+}
+
+// Convert the field value to be friendly for both formats.
+//
+func fieldValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case error:
+		return x.Error()
+	case time.Duration:
+		return x.String()
+	default:
+		return v
+	}
+}
+
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Whether the debug messages are enabled.
+//
+func DebugEnabled() bool {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	return logger.level <= LevelDebug
+}
+
+func DebugPrintf(format string, v ...interface{}) {
+	logf(LevelDebug, nil, format, v...)
 }
 
 func InfoPrintf(format string, v ...interface{}) {
-	format = fmt.Sprintf("[INFO] %s: %s", getOrigin(), format)
-	outLogger.Printf(format, v...)
+	logf(LevelInfo, nil, format, v...)
 }
 
 func WarnPrintf(format string, v ...interface{}) {
-	format = fmt.Sprintf("[WARNING] %s: %s", getOrigin(), format)
-	errLogger.Printf(format, v...)
+	logf(LevelWarn, nil, format, v...)
 }
 
 func ErrorPrintf(format string, v ...interface{}) {
-	format = fmt.Sprintf("[ERROR] %s: %s", getOrigin(), format)
-	errLogger.Printf(format, v...)
+	logf(LevelError, nil, format, v...)
 }
 
 func Fatalf(format string, v ...interface{}) {
-	format = fmt.Sprintf("[FATAL] %s: %s", getOrigin(), format)
-	errLogger.Fatalf(format, v...)
+	logf(LevelFatal, nil, format, v...)
+	os.Exit(1)
+}
+
+// Create a log entry with the given structured fields.
+//
+func WithFields(fields Fields) *Entry {
+	return &Entry{ fields: fields }
+}
+
+func (e *Entry) Debugf(format string, v ...interface{}) {
+	logf(LevelDebug, e.fields, format, v...)
+}
+
+func (e *Entry) Infof(format string, v ...interface{}) {
+	logf(LevelInfo, e.fields, format, v...)
+}
+
+func (e *Entry) Warnf(format string, v ...interface{}) {
+	logf(LevelWarn, e.fields, format, v...)
+}
+
+func (e *Entry) Errorf(format string, v ...interface{}) {
+	logf(LevelError, e.fields, format, v...)
 }
@@ -0,0 +1,109 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+
+func TestLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger.out, logger.err = &buf, &buf
+	defer setupLogger(&LogConfig{}, false)
+
+	logger.level = LevelWarn
+	DebugPrintf("debug\n")
+	InfoPrintf("info\n")
+	WarnPrintf("warning\n")
+	ErrorPrintf("error\n")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q\n", len(lines), buf.String())
+	}
+	if !strings.Contains(lines[0], "[WARNING]") ||
+	   !strings.HasSuffix(lines[0], ": warning") {
+		t.Errorf("unexpected line: %q\n", lines[0])
+	}
+	if !strings.Contains(lines[1], "[ERROR]") {
+		t.Errorf("unexpected line: %q\n", lines[1])
+	}
+}
+
+
+func TestLogText(t *testing.T) {
+	var buf bytes.Buffer
+	logger.out, logger.err = &buf, &buf
+	defer setupLogger(&LogConfig{}, false)
+
+	WithFields(Fields{
+		"mirror": "test",
+		"status": true,
+		"error": errors.New("no route"),
+	}).Infof("checked %s\n", "test")
+
+	line := buf.String()
+	want := `checked test error="no route" mirror=test status=true` + "\n"
+	if !strings.HasSuffix(line, want) {
+		t.Errorf("got %q, want suffix %q\n", line, want)
+	}
+	if !strings.Contains(line, "log_test.go:") ||
+	   !strings.Contains(line, ":TestLogText:") {
+		t.Errorf("origin missing: %q\n", line)
+	}
+}
+
+
+func TestLogJSON(t *testing.T) {
+	var buf bytes.Buffer
+	err := setupLogger(&LogConfig{ Level: "debug", Format: "json" }, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.out, logger.err = &buf, &buf
+	defer setupLogger(&LogConfig{}, false)
+
+	WithFields(Fields{
+		"mirror": "test",
+		"latency_ms": 12,
+		"msg": "overridden",
+	}).Debugf("checked\n")
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &obj); err != nil {
+		t.Fatalf("invalid JSON %q: %v\n", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"level": "debug",
+		"msg": "checked",
+		"mirror": "test",
+		"latency_ms": float64(12),
+	}
+	for k, v := range want {
+		if obj[k] != v {
+			t.Errorf("JSON[%q] = %v, want %v\n", k, obj[k], v)
+		}
+	}
+	if _, ok := obj["time"]; !ok {
+		t.Errorf("JSON missing time: %q\n", buf.String())
+	}
+}
+
+
+func TestSetupLoggerInvalid(t *testing.T) {
+	defer setupLogger(&LogConfig{}, false)
+
+	cases := []LogConfig{
+		{ Level: "verbose" },
+		{ Format: "xml" },
+		{ Output: "syslog", SyslogFacility: "kern" },
+	}
+	for _, tc := range cases {
+		if err := setupLogger(&tc, false); err == nil {
+			t.Errorf("setupLogger(%+v) succeeded; want error\n", tc)
+		}
+	}
+}
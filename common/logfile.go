@@ -0,0 +1,79 @@
+package common
+
+import (
+	"os"
+	"sync"
+)
+
+// A log file that can be reopened, e.g., after being rotated by
+// newsyslog(8).
+//
+type LogFile struct {
+	path	string
+	file	*os.File
+	mu	sync.Mutex
+}
+
+var (
+	logFiles	[]*LogFile
+	logFilesMu	sync.Mutex
+)
+
+// Open the log file for appending and register it for reopening.
+//
+func OpenLogFile(path string) (*LogFile, error) {
+	f, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lf := &LogFile{ path: path, file: f }
+	logFilesMu.Lock()
+	logFiles = append(logFiles, lf)
+	logFilesMu.Unlock()
+	return lf, nil
+}
+
+func openAppend(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+func (lf *LogFile) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.file.Write(p)
+}
+
+// Reopen the file at the same path; keep the old one on failure.
+//
+func (lf *LogFile) Reopen() error {
+	f, err := openAppend(lf.path)
+	if err != nil {
+		return err
+	}
+
+	lf.mu.Lock()
+	old := lf.file
+	lf.file = f
+	lf.mu.Unlock()
+	return old.Close()
+}
+
+func (lf *LogFile) Path() string {
+	return lf.path
+}
+
+// Reopen all the opened log files.
+//
+func ReopenLogFiles() {
+	logFilesMu.Lock()
+	defer logFilesMu.Unlock()
+	for _, lf := range logFiles {
+		if err := lf.Reopen(); err != nil {
+			ErrorPrintf("Failed to reopen log file (%s): %v\n",
+					lf.path, err)
+		} else {
+			InfoPrintf("Reopened log file: %s\n", lf.path)
+		}
+	}
+}
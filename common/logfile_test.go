@@ -0,0 +1,41 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+
+func TestLogFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	lf, err := OpenLogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lf.Write([]byte("line 1\n"))
+	// Simulate newsyslog(8) rotating the file.
+	rotated := path + ".0"
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	lf.Write([]byte("line 2\n"))
+	if err := lf.Reopen(); err != nil {
+		t.Fatalf("Reopen() failed: %v\n", err)
+	}
+	lf.Write([]byte("line 3\n"))
+
+	assertContent := func(fname, want string) {
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s: got %q, want %q\n", fname, data, want)
+		}
+	}
+	assertContent(rotated, "line 1\nline 2\n")
+	assertContent(path, "line 3\n")
+}
@@ -0,0 +1,231 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Default addresses to verify a (re)loaded MMDB.
+const (
+	defaultTestIPv4 = "8.8.8.8"
+	defaultTestIPv6 = "2001:4860:4860::8888"
+)
+
+// Open the configured MMDB files.
+//
+// The legacy [mmdb_type] and [mmdb_file] settings are taken as the only
+// database if the [[mmdb]] list is not given.
+//
+func readMMDBs(cfgfile string) {
+	if AppConfig.MMDBFile != "" || AppConfig.MMDBType != "" {
+		if len(AppConfig.MMDB) > 0 {
+			Fatalf("Config [mmdb_file] conflicts with [[mmdb]]\n")
+		}
+		AppConfig.MMDB = []*MMDBConfig{
+			{
+				TypeName: AppConfig.MMDBType,
+				File: AppConfig.MMDBFile,
+			},
+		}
+	}
+	if len(AppConfig.MMDB) == 0 {
+		Fatalf("Config [mmdb_file] or [[mmdb]] not set\n")
+	}
+
+	for i, mmdb := range AppConfig.MMDB {
+		setupMMDB(fmt.Sprintf("mmdb.%d", i), mmdb, cfgfile)
+	}
+
+	if mmdb := AppConfig.ASNMMDB; mmdb != nil && mmdb.File != "" {
+		mmdb.IsASN = true
+		setupMMDB("asn_mmdb", mmdb, cfgfile)
+	} else {
+		AppConfig.ASNMMDB = nil
+	}
+}
+
+// Validate the MMDB config and open the file.
+//
+func setupMMDB(name string, mmdb *MMDBConfig, cfgfile string) {
+	switch strings.ToLower(mmdb.TypeName) {
+	case "db-ip", "dbip":
+		mmdb.Type = MMDB_DBIP
+	case "maxmind":
+		mmdb.Type = MMDB_MAXMIND
+	default:
+		Fatalf("Config [%s.type] invalid: %v\n", name, mmdb.TypeName)
+	}
+
+	switch strings.ToLower(mmdb.Family) {
+	case "", "any":
+		mmdb.Family = "any"
+	case "ipv4", "ipv6":
+		mmdb.Family = strings.ToLower(mmdb.Family)
+	default:
+		Fatalf("Config [%s.family] invalid: %v\n", name, mmdb.Family)
+	}
+
+	if mmdb.TestIP == "" {
+		mmdb.TestIP = defaultTestIPv4
+		if mmdb.Family == "ipv6" {
+			mmdb.TestIP = defaultTestIPv6
+		}
+	}
+	if net.ParseIP(mmdb.TestIP) == nil {
+		Fatalf("Config [%s.test_ip] invalid: %v\n", name, mmdb.TestIP)
+	}
+
+	if mmdb.File == "" {
+		Fatalf("Config [%s.file] not set\n", name)
+	}
+	if mmdb.Edition != "" && mmdb.Type == MMDB_MAXMIND &&
+	   mmdb.LicenseKey == "" {
+		Fatalf("Config [%s.license_key] required to " +
+				"update MaxMind databases\n", name)
+	}
+	if !filepath.IsAbs(mmdb.File) {
+		mmdb.File = filepath.Join(filepath.Dir(cfgfile), mmdb.File)
+	}
+
+	db, info, err := openMMDB(mmdb.File)
+	if err != nil {
+		Fatalf("Failed to open MMDB: %v\n", err)
+	}
+	mmdb.DB, mmdb.fileInfo = db, info
+	InfoPrintf("Opened MMDB (%s): %s, type: %s, family: %s\n",
+			mmdb.TypeName, mmdb.File,
+			db.Metadata.DatabaseType, mmdb.Family)
+}
+
+// Get all the opened MMDBs, including the ASN one.
+//
+func (cfg *Config) AllMMDBs() []*MMDBConfig {
+	all := append([]*MMDBConfig{}, cfg.MMDB...)
+	if cfg.ASNMMDB != nil {
+		all = append(all, cfg.ASNMMDB)
+	}
+	return all
+}
+
+func openMMDB(path string) (*maxminddb.Reader, os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, info, nil
+}
+
+// Whether the MMDB should be used for the IP address.
+//
+func (mmdb *MMDBConfig) Match(ip net.IP) bool {
+	switch mmdb.Family {
+	case "ipv4":
+		return ip.To4() != nil
+	case "ipv6":
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// Lookup the IP address in the MMDB and decode the record into result.
+// The reader won't be closed by a reload during the lookup.
+//
+func (mmdb *MMDBConfig) Lookup(ip net.IP, result interface{}) (bool, error) {
+	mmdb.mu.RLock()
+	defer mmdb.mu.RUnlock()
+	_, ok, err := mmdb.DB.LookupNetwork(ip, result)
+	return ok, err
+}
+
+// Whether the MMDB file has been replaced or modified since opened.
+//
+func (mmdb *MMDBConfig) Changed() bool {
+	info, err := os.Stat(mmdb.File)
+	if err != nil {
+		// Probably being replaced; check again later.
+		return false
+	}
+
+	mmdb.mu.RLock()
+	defer mmdb.mu.RUnlock()
+	old := mmdb.fileInfo
+	return old == nil || !os.SameFile(old, info) ||
+			!old.ModTime().Equal(info.ModTime()) ||
+			old.Size() != info.Size()
+}
+
+// Open the MMDB file again, verify it and then swap it in place of the
+// current reader, which is closed after the in-flight lookups finish.
+// The current reader is kept if the new one fails the verification.
+//
+func (mmdb *MMDBConfig) Reload() error {
+	db, info, err := openMMDB(mmdb.File)
+	if err != nil {
+		return err
+	}
+	if err := mmdb.Verify(db); err != nil {
+		db.Close()
+		return err
+	}
+
+	mmdb.mu.Lock()
+	old := mmdb.DB
+	mmdb.DB, mmdb.fileInfo = db, info
+	mmdb.mu.Unlock()
+
+	if old != nil {
+		if t1, t2 := old.Metadata.DatabaseType,
+				db.Metadata.DatabaseType; t1 != t2 {
+			WarnPrintf("MMDB (%s) type changed: %s -> %s\n",
+					mmdb.File, t1, t2)
+		}
+		old.Close()
+	}
+	return nil
+}
+
+// Get the metadata of the current database.
+//
+func (mmdb *MMDBConfig) Metadata() maxminddb.Metadata {
+	mmdb.mu.RLock()
+	defer mmdb.mu.RUnlock()
+	return mmdb.DB.Metadata
+}
+
+// Verify the (new) database by looking up the test IP, which must have
+// a country, or an ASN for an ASN database.
+//
+func (mmdb *MMDBConfig) Verify(db *maxminddb.Reader) error {
+	var record struct {
+		Country struct {
+			Code string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		ASN uint `maxminddb:"autonomous_system_number"`
+	}
+
+	ip := net.ParseIP(mmdb.TestIP)
+	_, ok, err := db.LookupNetwork(ip, &record)
+	if err != nil {
+		return fmt.Errorf("Test lookup (%s) failed: %v", mmdb.TestIP, err)
+	}
+	if mmdb.IsASN {
+		if !ok || record.ASN == 0 {
+			return fmt.Errorf("Test lookup (%s) found no ASN",
+					mmdb.TestIP)
+		}
+	} else if !ok || record.Country.Code == "" {
+		return fmt.Errorf("Test lookup (%s) found no country",
+				mmdb.TestIP)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"net"
+)
+
+// Anonymize the IP address by truncating it to the configured network
+// prefix (default: /24 for IPv4 and /48 for IPv6), if enabled.
+//
+// NOTE: Only used for logging and aggregation; the GeoIP lookup always
+//       uses the full address.
+//
+func AnonymizeIP(ip net.IP) net.IP {
+	cfg := &AppConfig.Privacy
+	if !cfg.AnonymizeIP {
+		return ip
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(cfg.IPv4Prefix, 32))
+	}
+	return ip.Mask(net.CIDRMask(cfg.IPv6Prefix, 128))
+}
+
+// Same as AnonymizeIP() but for an IP string; an invalid one is
+// returned as-is.
+//
+func AnonymizeIPString(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return s
+	}
+	return AnonymizeIP(ip).String()
+}
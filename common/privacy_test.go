@@ -0,0 +1,65 @@
+package common
+
+import (
+	"net"
+	"testing"
+)
+
+
+func TestAnonymizeIP(t *testing.T) {
+	cases := []struct {
+		ip string
+		want string
+	}{
+		{ "199.233.90.68", "199.233.90.0" },
+		{ "::ffff:202.120.2.119", "202.120.2.0" },
+		{ "2001:470:1:43b:1::68", "2001:470:1::" },
+	}
+
+	defer func(cfg PrivacyConfig) { AppConfig.Privacy = cfg }(
+			AppConfig.Privacy)
+	AppConfig.Privacy.IPv4Prefix = 24
+	AppConfig.Privacy.IPv6Prefix = 48
+
+	AppConfig.Privacy.AnonymizeIP = false
+	for _, tc := range cases {
+		ip := net.ParseIP(tc.ip)
+		if got := AnonymizeIP(ip); !got.Equal(ip) {
+			t.Errorf("AnonymizeIP(%v) = %v, want unchanged\n", ip, got)
+		}
+	}
+
+	AppConfig.Privacy.AnonymizeIP = true
+	for _, tc := range cases {
+		ip := net.ParseIP(tc.ip)
+		if got := AnonymizeIP(ip); got.String() != tc.want {
+			t.Errorf("AnonymizeIP(%v) = %v, want %v\n", ip, got, tc.want)
+		}
+	}
+}
+
+
+func TestAnonymizeIPPrefix(t *testing.T) {
+	defer func(cfg PrivacyConfig) { AppConfig.Privacy = cfg }(
+			AppConfig.Privacy)
+	AppConfig.Privacy = PrivacyConfig{
+		AnonymizeIP: true,
+		IPv4Prefix: 16,
+		IPv6Prefix: 32,
+	}
+
+	cases := []struct {
+		ip string
+		want string
+	}{
+		{ "199.233.90.68", "199.233.0.0" },
+		{ "2001:470:1:43b:1::68", "2001:470::" },
+		{ "not-an-ip", "not-an-ip" },
+	}
+	for _, tc := range cases {
+		if got := AnonymizeIPString(tc.ip); got != tc.want {
+			t.Errorf("AnonymizeIPString(%q) = %q, want %q\n",
+					tc.ip, got, tc.want)
+		}
+	}
+}
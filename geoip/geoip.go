@@ -11,11 +11,30 @@ import (
 
 var appConfig = common.AppConfig
 
+// Tiers of the selected mirrors
+const (
+	TierOverride	= "override"
+	TierASN		= "asn"
+	TierCountry	= "country"
+	TierRegion	= "region"
+	TierSubregion	= "subregion"
+	TierContinent	= "continent"
+	TierWorld	= "world"
+	TierFallback	= "fallback"
+	TierDefault	= "default"
+)
+
 type Location struct {
 	ContinentCode	string
 	CountryCode	string
 	Latitude	float64
 	Longitude	float64
+	// Whether the coordinates are known, or just the centroid of the
+	// country (or zero if unknown either).
+	HasCoordinates	bool
+	AccuracyRadius	uint       // in km; 0 if unknown
+	ASN		uint       // autonomous system number; 0 if unknown
+	Override	*Override  // matched network override, if any
 }
 
 type Point struct {
@@ -36,84 +55,225 @@ type Record struct {
 	Location struct {
 		Latitude	float64 `maxminddb:"latitude"`
 		Longitude	float64 `maxminddb:"longitude"`
+		// Not available in DB-IP Lite
+		AccuracyRadius	uint    `maxminddb:"accuracy_radius"`
 	} `maxminddb:"location"`
 }
 
 
 // Lookup the location data in MMDB for the IP address.
 //
+// The network overrides are consulted first, and the databases are
+// skipped if the matched override forces the location.
+//
+// The databases are tried in the configured order until both the
+// country and coordinates are found; the missing fields of a record
+// are merged from the following databases.
+//
+// If the coordinates are still unknown (e.g., country-level databases),
+// the centroid of the country is used instead.
+//
 func LookupIP(ip net.IP) (*Location, error) {
-	var record Record
-	_, ok, err := appConfig.MMDB.DB.LookupNetwork(ip, &record)
-	if err != nil {
-		return nil, err
+	var location *Location
+	var err error
+	override := LookupOverride(ip)
+	if override != nil && override.Location != nil {
+		loc := *override.Location
+		location = &loc
+	} else {
+		location, err = lookupMMDBs(ip)
+	}
+
+	if override != nil {
+		if location == nil {
+			location = &Location{}
+		}
+		location.Override = override
+		err = nil
 	}
-	if !ok {
-		return nil, fmt.Errorf("No data for IP (%s)", ip.String())
+	if location != nil {
+		location.ASN = lookupASN(ip)
+		location.fillCoordinates()
+	}
+	return location, err
+}
+
+// Lookup the autonomous system number in the ASN database, if any.
+//
+func lookupASN(ip net.IP) uint {
+	mmdb := appConfig.ASNMMDB
+	if mmdb == nil || !mmdb.Match(ip) {
+		return 0
 	}
 
-	location := Location{
-		ContinentCode: record.Continent.Code,
-		CountryCode:   record.Country.Code,
-		Latitude:      record.Location.Latitude,
-		Longitude:     record.Location.Longitude,
+	var record struct {
+		ASN uint `maxminddb:"autonomous_system_number"`
 	}
-	return &location, nil
+	ok, err := mmdb.Lookup(ip, &record)
+	if err != nil || !ok {
+		return 0
+	}
+	return record.ASN
 }
 
+func lookupMMDBs(ip net.IP) (*Location, error) {
+	var location *Location
+	var lastErr error
+	for _, mmdb := range appConfig.MMDB {
+		if !mmdb.Match(ip) {
+			continue
+		}
 
-// Find mirrors that suit the given location.
+		var record Record
+		ok, err := mmdb.Lookup(ip, &record)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		location = mergeRecord(location, &record)
+		if location.CountryCode != "" && location.hasCoordinates() {
+			break
+		}
+	}
+
+	if location == nil {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, fmt.Errorf("No data for IP (%s)",
+				common.AnonymizeIP(ip).String())
+	}
+	return location, nil
+}
+
+// Merge the record into the location found so far.
 //
-// Rules:
-// - Prefer mirrors of the same country.
-// - Then prefer mirrors of the same continent.
-// - Fallback to the default mirror.
-// - If multiple mirrors in the same country/continent, order by
-//   distance via latitude/longitude.
-// - Append the default to the last as the fallback.
-// - If location is nil, then return the default mirror.
+// The coordinates are only taken from a record of the same country,
+// so that they won't be mixed up between disagreeing databases.
 //
-func FindMirrors(location *Location) []*common.Mirror {
+func mergeRecord(location *Location, record *Record) *Location {
 	if location == nil {
-		// Return the default mirror
-		for _, mirror := range appConfig.Mirrors {
-			if mirror.IsDefault {
-				return []*common.Mirror{ mirror }
-			}
-		}
+		location = &Location{}
+	}
+
+	if location.CountryCode == "" {
+		location.CountryCode = record.Country.Code
+		location.ContinentCode = record.Continent.Code
+	}
+	if location.ContinentCode == "" &&
+	   record.Country.Code == location.CountryCode {
+		location.ContinentCode = record.Continent.Code
 	}
 
-	var m_default *common.Mirror
-	var m_country, m_continent []*common.Mirror
-	for _, mirror := range appConfig.Mirrors {
-		if mirror.IsDefault {
-			// Always use it even if offline
-			m_default = mirror
+	hasCoords := record.Location.Latitude != 0 ||
+			record.Location.Longitude != 0
+	if !location.hasCoordinates() && hasCoords &&
+	   (record.Country.Code == "" ||
+	    record.Country.Code == location.CountryCode) {
+		location.Latitude = record.Location.Latitude
+		location.Longitude = record.Location.Longitude
+		location.AccuracyRadius = record.Location.AccuracyRadius
+	}
+
+	return location
+}
+
+func (loc *Location) hasCoordinates() bool {
+	return loc.Latitude != 0 || loc.Longitude != 0
+}
+
+// Mark whether the coordinates are known, otherwise fallback to the
+// centroid of the country.
+//
+func (loc *Location) fillCoordinates() {
+	loc.HasCoordinates = loc.hasCoordinates()
+	if loc.HasCoordinates {
+		return
+	}
+	if p, ok := CountryCentroid(loc.CountryCode); ok {
+		loc.Latitude, loc.Longitude = p.Latitude, p.Longitude
+	}
+}
+
+
+// Find mirrors that suit the given location with the default "tier"
+// selector.
+//
+// Rules:
+// - Walk through the configured tiers (e.g., country, region, subregion,
+//   continent, world) in order and take the online mirrors of the first
+//   tier that has any; only the nearest [world_mirrors] ones of the world
+//   tier.
+// - Mirrors in the same autonomous system (ASN tier) don't stop the
+//   walk but are placed ahead of the mirrors of the next matched tier.
+// - Fallback to the default mirror.
+// - If multiple mirrors in the same tier, order by distance via
+//   latitude/longitude.
+// - Append the default to the last as the fallback, preceded by the
+//   online fallback mirrors if the default is offline.
+// - If location is nil, then return the online fallback mirrors and the
+//   default mirror.
+// - If the location has an override with preferred mirrors, use the
+//   online ones of them instead.
+//
+// The tier that matched is also returned.
+//
+func FindMirrors(location *Location) ([]*common.Mirror, string) {
+	selections := selectMirrors(&tierSelector{}, &Client{
+		Location: location,
+	})
+	return SelectedMirrors(selections), selections[0].Reason
+}
+
+// Select the mirrors of the first matched tier, preceded by the ones
+// in the same autonomous system.
+//
+func findTierMirrors(candidates []*common.Mirror,
+		location *Location) []*Selection {
+	var selections []*Selection
+	for _, name := range tiers {
+		match := tierMatchers[name]
+		var matched, rest []*common.Mirror
+		for _, mirror := range candidates {
+			if match(mirror, location) {
+				matched = append(matched, mirror)
+			} else {
+				rest = append(rest, mirror)
+			}
 		}
-		if !mirror.Status.Online {
+		if len(matched) == 0 {
 			continue
 		}
-		if mirror.CountryCode == location.CountryCode {
-			m_country = append(m_country, mirror)
+
+		sort.SliceStable(matched, fLess(matched, location))
+		if n := appConfig.WorldMirrors; name == TierWorld &&
+		   n > 0 && n < len(matched) {
+			// Only the nearest ones of the whole world
+			matched = matched[:n]
 		}
-		if mirror.ContinentCode == location.ContinentCode {
-			m_continent = append(m_continent, mirror)
+		selections = append(selections, newSelections(matched, name)...)
+		if name != TierASN {
+			break
 		}
+		candidates = rest
 	}
+	return selections
+}
 
-	sort.Slice(m_country, fLess(m_country, location))
-	sort.Slice(m_continent, fLess(m_continent, location))
 
-	mirrors := []*common.Mirror{}
-	if len(m_country) > 0 {
-		mirrors = append(mirrors, m_country...)
-	} else if len(m_continent) > 0 {
-		mirrors = append(mirrors, m_continent...)
+// Whether the mirror is hosted in the autonomous system.
+//
+func hasASN(mirror *common.Mirror, asn uint) bool {
+	for _, n := range mirror.ASN {
+		if n == asn {
+			return true
+		}
 	}
-	// Append the default mirror as fallback
-	mirrors = append(mirrors, m_default)
-
-	return mirrors
+	return false
 }
 
 
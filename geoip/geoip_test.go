@@ -5,6 +5,8 @@ import (
 	"net"
 	"testing"
 
+	"github.com/oschwald/maxminddb-golang"
+
 	"github.com/DragonFlyBSD/mirrorselect/common"
 )
 
@@ -12,6 +14,9 @@ import (
 func init() {
 	fname := "../testdata/mirrorselect.toml"
 	common.ReadConfig(fname)
+	if err := SetupTiers(); err != nil {
+		panic(err)
+	}
 }
 
 
@@ -77,18 +82,111 @@ func TestLookupIP2(t *testing.T) {
 }
 
 
+// Open the test MMDB file and use it for the given address family.
+//
+func openMMDB(t *testing.T, path, family string) *common.MMDBConfig {
+	t.Helper()
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &common.MMDBConfig{ File: path, Family: family, DB: db }
+}
+
+
+func TestLookupIPMulti(t *testing.T) {
+	accurate := cityRecord("NA", "US", 40.71, -74.01)
+	accurate["location"].(map[string]interface{})["accuracy_radius"] =
+			uint16(20)
+	city := writeMMDB(t, "City", []mmdbEntry{
+		{ "192.0.2.0/24", cityRecord("EU", "FR", 48.85, 2.35) },
+		{ "100.64.0.0/24", accurate },
+		{ "203.0.113.0/25", countryRecord("EU", "DE") },
+		{ "203.0.113.128/25", countryRecord("EU", "DE") },
+	})
+	city2 := writeMMDB(t, "City2", []mmdbEntry{
+		{ "203.0.113.0/25", cityRecord("EU", "DE", 52.52, 13.40) },
+		{ "203.0.113.128/25", cityRecord("EU", "FR", 48.85, 2.35) },
+	})
+	country := writeMMDB(t, "Country", []mmdbEntry{
+		{ "192.0.2.0/24", countryRecord("EU", "GB") },
+		{ "198.51.100.0/24", countryRecord("AS", "JP") },
+	})
+	v4only := writeMMDB(t, "IPv4", []mmdbEntry{
+		{ "2001:db8::/32", cityRecord("NA", "US", 37.33, -121.9) },
+	})
+	v6only := writeMMDB(t, "IPv6", []mmdbEntry{
+		{ "2001:db8::/32", cityRecord("AS", "JP", 35.68, 139.69) },
+	})
+
+	saved := appConfig.MMDB
+	defer func() { appConfig.MMDB = saved }()
+	appConfig.MMDB = []*common.MMDBConfig{
+		openMMDB(t, city, "any"),
+		openMMDB(t, city2, "any"),
+		openMMDB(t, country, "any"),
+		openMMDB(t, v4only, "ipv4"),
+		openMMDB(t, v6only, "ipv6"),
+	}
+
+	// Location with known coordinates
+	known := func(loc *Location, radius uint) *Location {
+		loc.HasCoordinates = true
+		loc.AccuracyRadius = radius
+		return loc
+	}
+	cases := []struct {
+		ip string
+		location *Location
+	}{
+		// Found in the first database
+		{ "192.0.2.1", known(newLocation("EU", "FR", 48.85, 2.35), 0) },
+		{ "100.64.0.1", known(newLocation("NA", "US", 40.71, -74.01), 20) },
+		// Fallback to the country-only database and the centroid
+		{ "198.51.100.1", newLocation("AS", "JP", 36.204824, 138.252924) },
+		// Coordinates merged from the second database
+		{ "203.0.113.1", known(newLocation("EU", "DE", 52.52, 13.40), 0) },
+		// Coordinates of another country are not merged
+		{ "203.0.113.129", newLocation("EU", "DE", 51.165691, 10.451526) },
+		// IPv4-only database skipped
+		{ "2001:db8::1", known(newLocation("AS", "JP", 35.68, 139.69), 0) },
+		// No data
+		{ "233.252.0.1", nil },
+	}
+
+	for _, tc := range cases {
+		ip := net.ParseIP(tc.ip)
+		loc, err := LookupIP(ip)
+		if tc.location == nil {
+			if loc != nil || err == nil {
+				t.Errorf("LookupIP(%v) = (%v, %v), want nil location and error",
+						ip, loc, err)
+			}
+			continue
+		}
+		if loc == nil || *loc != *tc.location {
+			t.Errorf("LookupIP(%v) = (%v, %v), want %v",
+					ip, loc, err, tc.location)
+		}
+	}
+}
+
+
 func TestFindMirrors(t *testing.T) {
 	cases := []struct {
 		location *Location
 		mirror_count int
 		mirror_first string  // name of mirror
 		mirror_last string
+		tier string
 	}{
 		{
 			location: nil,
-			mirror_count: 1,
-			mirror_first: "SJTUG",
+			mirror_count: 2,
+			mirror_first: "DragonFly/Avalon",
 			mirror_last: "SJTUG",
+			tier: TierFallback,
 		},
 		{
 			// leaf.dragonflybsd.org (199.233.90.68)
@@ -101,6 +199,7 @@ func TestFindMirrors(t *testing.T) {
 			mirror_count: 2,
 			mirror_first: "DragonFly/Avalon",
 			mirror_last: "SJTUG",
+			tier: TierCountry,
 		},
 		{
 			// www.sjtu.edu.cn (202.120.2.119)
@@ -110,14 +209,19 @@ func TestFindMirrors(t *testing.T) {
 				Latitude: 31.201,
 				Longitude: 121.433,
 			},
-			mirror_count: 2,
+			mirror_count: 1,
 			mirror_first: "SJTUG",
 			mirror_last: "SJTUG",
+			tier: TierCountry,
 		},
 	}
 
 	for _, tc := range cases {
-		mirrors := FindMirrors(tc.location)
+		mirrors, tier := FindMirrors(tc.location)
+		if tier != tc.tier {
+			t.Errorf("FindMirrors(%v) failed: got tier %q, want %q",
+					tc.location, tier, tc.tier)
+		}
 		if len(mirrors) != tc.mirror_count {
 			t.Errorf("FindMirrors(%v) failed: got %d mirrors, want %d",
 					tc.location, len(mirrors), tc.mirror_count)
@@ -185,3 +289,389 @@ func TestGreatCircleDistance(t *testing.T) {
 		}
 	}
 }
+
+
+func TestLookupASN(t *testing.T) {
+	path := writeMMDB(t, "ASN", []mmdbEntry{
+		{ "202.120.0.0/16", map[string]interface{}{
+			"autonomous_system_number": uint32(4538),
+			"autonomous_system_organization": "CERNET",
+		} },
+	})
+	saved := appConfig.ASNMMDB
+	defer func() { appConfig.ASNMMDB = saved }()
+	appConfig.ASNMMDB = openMMDB(t, path, "any")
+	appConfig.ASNMMDB.IsASN = true
+
+	cases := []struct {
+		ip string
+		asn uint
+	}{
+		{ "202.120.2.119", 4538 },  // www.sjtu.edu.cn
+		{ "199.233.90.68", 0 },     // leaf.dragonflybsd.org
+	}
+	for _, tc := range cases {
+		ip := net.ParseIP(tc.ip)
+		loc, err := LookupIP(ip)
+		if loc == nil || loc.ASN != tc.asn {
+			t.Errorf("LookupIP(%v) = (%+v, %v), want ASN %d",
+					ip, loc, err, tc.asn)
+		}
+	}
+}
+
+
+func TestFindMirrorsASN(t *testing.T) {
+	shanghai := newTestMirror("Shanghai", "AS", "CN", 31.2, 121.4)
+	beijing := newTestMirror("Beijing", "AS", "CN", 39.9, 116.4)
+	tokyo := newTestMirror("Tokyo", "AS", "JP", 35.7, 139.7)
+	beijing.ASN = []uint{ 4538 }
+	tokyo.ASN = []uint{ 2500 }
+	shanghai.IsDefault = true
+	setTestMirrors(t, shanghai, beijing, tokyo)
+
+	location := &Location{
+		ContinentCode: "AS",
+		CountryCode: "CN",
+		Latitude: 31.2,
+		Longitude: 121.4,
+		ASN: 4538,
+	}
+	want := []string{ "Beijing", "Shanghai" }
+	mirrors, tier := FindMirrors(location)
+	if tier != TierASN || !sameMirrors(mirrors, want) {
+		t.Errorf("FindMirrors(%+v) = (%v, %s), want (%v, %s)",
+				location, mirrorNames(mirrors), tier, want, TierASN)
+	}
+
+	// Same ASN mirror in another country
+	location.ASN = 2500
+	want = []string{ "Tokyo", "Beijing", "Shanghai" }
+	mirrors, tier = FindMirrors(location)
+	if tier != TierASN || !sameMirrors(mirrors, want) {
+		t.Errorf("FindMirrors(%+v) = (%v, %s), want (%v, %s)",
+				location, mirrorNames(mirrors), tier, want, TierASN)
+	}
+}
+
+
+func TestFindMirrorsTiers(t *testing.T) {
+	savedRegions, savedTiers := appConfig.Regions, appConfig.Tiers
+	defer func() {
+		appConfig.Regions, appConfig.Tiers = savedRegions, savedTiers
+		SetupTiers()
+	}()
+	tokyo := newTestMirror("Tokyo", "AS", "JP", 35.7, 139.7)
+	tokyo.IsDefault = true
+	setTestMirrors(t,
+		newTestMirror("Frankfurt", "EU", "DE", 50.1, 8.7),
+		newTestMirror("Madrid", "EU", "ES", 40.4, -3.7),
+		newTestMirror("Warsaw", "EU", "PL", 52.2, 21.0),
+		newTestMirror("Moscow", "EU", "RU", 55.8, 37.6),
+		newTestMirror("Istanbul", "AS", "TR", 41.0, 29.0),
+		tokyo,
+	)
+	appConfig.Regions = []*common.RegionConfig{
+		{
+			Name: "Eastern Europe and Caucasus",
+			Countries: []string{ "ru", "tr", "ge", "am", "az" },
+		},
+	}
+
+	cases := []struct {
+		tiers []string
+		location *Location
+		want []string
+		tier string
+	}{
+		{
+			tiers: savedTiers,
+			location: newLocation("EU", "DE", 52.5, 13.4),
+			want: []string{ "Frankfurt", "Tokyo" },
+			tier: TierCountry,
+		},
+		{
+			// Portugal => Southern Europe
+			tiers: savedTiers,
+			location: newLocation("EU", "PT", 38.7, -9.1),
+			want: []string{ "Madrid", "Tokyo" },
+			tier: TierSubregion,
+		},
+		{
+			// Netherlands => Western Europe
+			tiers: savedTiers,
+			location: newLocation("EU", "NL", 52.4, 4.9),
+			want: []string{ "Frankfurt", "Tokyo" },
+			tier: TierSubregion,
+		},
+		{
+			// Georgia => configured region
+			tiers: savedTiers,
+			location: newLocation("AS", "GE", 41.7, 44.8),
+			want: []string{ "Istanbul", "Moscow", "Tokyo" },
+			tier: TierRegion,
+		},
+		{
+			// Ireland => Northern Europe has no mirrors
+			tiers: savedTiers,
+			location: newLocation("EU", "IE", 53.3, -6.3),
+			want: []string{
+				"Frankfurt", "Madrid", "Warsaw", "Moscow", "Tokyo",
+			},
+			tier: TierContinent,
+		},
+		{
+			tiers: []string{ "country", "continent" },
+			location: newLocation("EU", "PT", 38.7, -9.1),
+			want: []string{
+				"Madrid", "Frankfurt", "Warsaw", "Moscow", "Tokyo",
+			},
+			tier: TierContinent,
+		},
+		{
+			tiers: []string{ "country", "continent", "world" },
+			location: newLocation("AF", "EG", 30.0, 31.2),
+			// Only the nearest 3 (world_mirrors) of the world
+			want: []string{ "Istanbul", "Warsaw", "Moscow", "Tokyo" },
+			tier: TierWorld,
+		},
+		{
+			tiers: []string{ "country", "continent" },
+			location: newLocation("AF", "EG", 30.0, 31.2),
+			want: []string{ "Tokyo" },
+			tier: TierDefault,
+		},
+	}
+	for _, tc := range cases {
+		appConfig.Tiers = tc.tiers
+		if err := SetupTiers(); err != nil {
+			t.Fatalf("SetupTiers(%v) failed: %v", tc.tiers, err)
+		}
+		mirrors, tier := FindMirrors(tc.location)
+		if tier != tc.tier || !sameMirrors(mirrors, tc.want) {
+			t.Errorf("FindMirrors(%+v) with tiers %v = (%v, %s), " +
+					"want (%v, %s)", tc.location, tc.tiers,
+					mirrorNames(mirrors), tier,
+					tc.want, tc.tier)
+		}
+	}
+}
+
+
+func TestFindMirrorsWorld(t *testing.T) {
+	sanjose := newTestMirror("San Jose", "NA", "US", 37.3, -121.9)
+	sanjose.IsDefault = true
+	setTestMirrors(t,
+		sanjose,
+		newTestMirror("Frankfurt", "EU", "DE", 50.1, 8.7),
+		newTestMirror("Tokyo", "AS", "JP", 35.7, 139.7),
+	)
+
+	cases := []struct {
+		location *Location
+		want []string
+	}{
+		{
+			// Nairobi, Kenya
+			location: newLocation("AF", "KE", -1.3, 36.8),
+			want: []string{
+				"Frankfurt", "Tokyo", "San Jose",
+			},
+		},
+		{
+			// Johannesburg, South Africa
+			location: newLocation("AF", "ZA", -26.2, 28.0),
+			want: []string{
+				"Frankfurt", "Tokyo", "San Jose",
+			},
+		},
+		{
+			// Sydney, Australia
+			location: newLocation("OC", "AU", -33.9, 151.2),
+			want: []string{
+				"Tokyo", "Frankfurt", "San Jose",
+			},
+		},
+		{
+			// Auckland, New Zealand
+			location: newLocation("OC", "NZ", -36.8, 174.8),
+			want: []string{
+				"Tokyo", "Frankfurt", "San Jose",
+			},
+		},
+	}
+	for _, tc := range cases {
+		mirrors, tier := FindMirrors(tc.location)
+		if tier != TierWorld || !sameMirrors(mirrors, tc.want) {
+			t.Errorf("FindMirrors(%+v) = (%v, %s), want (%v, %s)",
+					tc.location, mirrorNames(mirrors), tier,
+					tc.want, TierWorld)
+		}
+	}
+
+	// Only the nearest ones
+	saved := appConfig.WorldMirrors
+	defer func() { appConfig.WorldMirrors = saved }()
+	appConfig.WorldMirrors = 1
+	for i, want := range [][]string{
+		{ "Frankfurt", "San Jose" },
+		{ "Frankfurt", "San Jose" },
+		{ "Tokyo", "San Jose" },
+		{ "Tokyo", "San Jose" },
+	} {
+		location := cases[i].location
+		mirrors, tier := FindMirrors(location)
+		if tier != TierWorld || !sameMirrors(mirrors, want) {
+			t.Errorf("FindMirrors(%+v) with world_mirrors = 1 = " +
+					"(%v, %s), want (%v, %s)", location,
+					mirrorNames(mirrors), tier, want, TierWorld)
+		}
+	}
+
+	// Only the default mirror if all the others are offline
+	for _, m := range appConfig.Mirrors {
+		m.Status.Online = m.IsDefault
+	}
+	location := cases[0].location
+	want := []string{ "San Jose" }
+	mirrors, tier := FindMirrors(location)
+	if tier != TierWorld || !sameMirrors(mirrors, want) {
+		t.Errorf("FindMirrors(%+v) = (%v, %s), want (%v, %s)",
+				location, mirrorNames(mirrors), tier,
+				want, TierWorld)
+	}
+}
+
+
+func TestSetupTiersInvalid(t *testing.T) {
+	savedTiers, savedRegions := appConfig.Tiers, appConfig.Regions
+	defer func() {
+		appConfig.Tiers, appConfig.Regions = savedTiers, savedRegions
+		SetupTiers()
+	}()
+
+	cases := []struct {
+		tiers []string
+		regions []*common.RegionConfig
+	}{
+		{ tiers: []string{} },
+		{ tiers: []string{ "country", "planet" } },
+		{ tiers: []string{ "country", "Country" } },
+		{
+			tiers: []string{ "region" },
+			regions: []*common.RegionConfig{
+				{ Countries: []string{ "RU" } },
+			},
+		},
+		{
+			tiers: []string{ "region" },
+			regions: []*common.RegionConfig{ { Name: "Empty" } },
+		},
+	}
+	for _, tc := range cases {
+		appConfig.Tiers, appConfig.Regions = tc.tiers, tc.regions
+		if err := SetupTiers(); err == nil {
+			t.Errorf("SetupTiers(%v, %v) succeeded, want error",
+					tc.tiers, tc.regions)
+		}
+	}
+}
+
+
+func TestCountryCentroid(t *testing.T) {
+	// Every country with a sub-region has a centroid.
+	for cc := range countrySubregion {
+		if _, ok := CountryCentroid(cc); !ok {
+			t.Errorf("CountryCentroid(%q) not found", cc)
+		}
+	}
+
+	p, ok := CountryCentroid("PT")
+	if !ok || math.Abs(p.Latitude - 39.4) > 0.1 ||
+	   math.Abs(p.Longitude + 8.2) > 0.1 {
+		t.Errorf("CountryCentroid(%q) = (%v, %v), want (39.4, -8.2)",
+				"PT", p, ok)
+	}
+	if _, ok := CountryCentroid(""); ok {
+		t.Errorf("CountryCentroid(%q) found, want not found", "")
+	}
+}
+
+
+func TestSubregion(t *testing.T) {
+	cases := map[string]string{
+		"PT": "Southern Europe",
+		"NL": "Western Europe",
+		"RU": "Eastern Europe",
+		"TR": "Western Asia",
+		"US": "Northern America",
+		"MX": "Central America",
+		"ZA": "Southern Africa",
+		"NZ": "Australia and New Zealand",
+		"AQ": "",
+		"": "",
+	}
+	for cc, want := range cases {
+		if got := Subregion(cc); got != want {
+			t.Errorf("Subregion(%q) = %q, want %q", cc, got, want)
+		}
+	}
+}
+
+
+func newLocation(continent, country string, lat, lon float64) *Location {
+	return &Location{
+		ContinentCode: continent,
+		CountryCode: country,
+		Latitude: lat,
+		Longitude: lon,
+	}
+}
+
+// Create an online mirror for the tests.
+//
+func newTestMirror(name, continent, country string,
+		lat, lon float64) *common.Mirror {
+	return &common.Mirror{
+		Name: name,
+		ContinentCode: continent,
+		CountryCode: country,
+		Latitude: lat,
+		Longitude: lon,
+		Status: common.MirrorStatus{ Online: true },
+	}
+}
+
+// Replace the configured mirrors with the given ones (keyed by their
+// names) for the test, and restore them on cleanup.
+//
+func setTestMirrors(t *testing.T, mirrors ...*common.Mirror) {
+	t.Helper()
+	saved := appConfig.Mirrors
+	t.Cleanup(func() { appConfig.Mirrors = saved })
+	appConfig.Mirrors = make(map[string]*common.Mirror, len(mirrors))
+	for _, m := range mirrors {
+		appConfig.Mirrors[m.Name] = m
+	}
+}
+
+func mirrorNames(mirrors []*common.Mirror) []string {
+	names := []string{}
+	for _, m := range mirrors {
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+func sameMirrors(mirrors []*common.Mirror, names []string) bool {
+	got := mirrorNames(mirrors)
+	if len(got) != len(names) {
+		return false
+	}
+	for i := range got {
+		if got[i] != names[i] {
+			return false
+		}
+	}
+	return true
+}
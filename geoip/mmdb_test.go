@@ -0,0 +1,213 @@
+//
+// A minimal MaxMind DB writer to generate small test fixtures.
+//
+// Reference: https://maxmind.github.io/MaxMind-DB/
+//
+
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// A network and its record data in the test MMDB.
+type mmdbEntry struct {
+	cidr	string
+	data	map[string]interface{}
+}
+
+type mmdbNode struct {
+	children	[2]*mmdbNode
+	data		[]byte  // leaf only
+}
+
+// Generate an MMDB file in a temporary directory and return its path.
+//
+func writeMMDB(t *testing.T, dbType string, entries []mmdbEntry) string {
+	t.Helper()
+
+	data := buildMMDB(t, dbType, 1700000000, entries)
+	path := filepath.Join(t.TempDir(), dbType + ".mmdb")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Build an IPv6 MMDB (IPv4 networks mapped into ::/96).
+//
+func buildMMDB(t *testing.T, dbType string, epoch uint64,
+		entries []mmdbEntry) []byte {
+	t.Helper()
+
+	root := &mmdbNode{}
+	for _, e := range entries {
+		_, ipnet, err := net.ParseCIDR(e.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, bits := ipnet.Mask.Size()
+		ip := ipnet.IP.To16()
+		if bits == 32 {
+			ones += 96
+			ip = append(make(net.IP, 12), ipnet.IP.To4()...)
+		}
+
+		var data bytes.Buffer
+		mmdbEncode(&data, e.data)
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &mmdbNode{}
+			}
+			node = node.children[bit]
+		}
+		node.data = data.Bytes()
+	}
+
+	// Number the inner nodes and lay out the leaf data.
+	var nodes []*mmdbNode
+	index := map[*mmdbNode]int{}
+	var walk func(n *mmdbNode)
+	walk = func(n *mmdbNode) {
+		index[n] = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil && c.data == nil {
+				walk(c)
+			}
+		}
+	}
+	walk(root)
+
+	var section bytes.Buffer
+	offset := map[*mmdbNode]int{}
+	for _, n := range nodes {
+		for _, c := range n.children {
+			if c != nil && c.data != nil {
+				offset[c] = section.Len()
+				section.Write(c.data)
+			}
+		}
+	}
+
+	// 24-bit records
+	count := len(nodes)
+	var out bytes.Buffer
+	for _, n := range nodes {
+		for _, c := range n.children {
+			v := count  // empty
+			if c != nil && c.data != nil {
+				v = count + 16 + offset[c]
+			} else if c != nil {
+				v = index[c]
+			}
+			out.Write([]byte{ byte(v >> 16), byte(v >> 8), byte(v) })
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(section.Bytes())
+
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	mmdbEncode(&out, map[string]interface{}{
+		"node_count": uint32(count),
+		"record_size": uint16(24),
+		"ip_version": uint16(6),
+		"database_type": dbType,
+		"languages": []interface{}{ "en" },
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch": epoch,
+		"description": map[string]interface{}{ "en": "test" },
+	})
+	return out.Bytes()
+}
+
+// Encode the value in the MMDB data section format.
+//
+func mmdbEncode(buf *bytes.Buffer, value interface{}) {
+	control := func(typ, size int) {
+		var ext byte
+		if typ > 7 {
+			ext = byte(typ - 7)
+			typ = 0
+		}
+		var extra []byte
+		if size >= 285 {
+			extra = []byte{ byte((size - 285) >> 8), byte(size - 285) }
+			size = 30
+		} else if size >= 29 {
+			extra = []byte{ byte(size - 29) }
+			size = 29
+		}
+		buf.WriteByte(byte(typ << 5) | byte(size))
+		if typ == 0 {
+			buf.WriteByte(ext)
+		}
+		buf.Write(extra)
+	}
+
+	switch v := value.(type) {
+	case string:
+		control(2, len(v))
+		buf.WriteString(v)
+	case float64:
+		control(3, 8)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case uint16:
+		control(5, 2)
+		binary.Write(buf, binary.BigEndian, v)
+	case uint32:
+		control(6, 4)
+		binary.Write(buf, binary.BigEndian, v)
+	case uint64:
+		control(9, 8)
+		binary.Write(buf, binary.BigEndian, v)
+	case []interface{}:
+		control(11, len(v))
+		for _, e := range v {
+			mmdbEncode(buf, e)
+		}
+	case map[string]interface{}:
+		control(7, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			mmdbEncode(buf, k)
+			mmdbEncode(buf, v[k])
+		}
+	default:
+		panic("mmdbEncode: unsupported type")
+	}
+}
+
+// Build a city-level record.
+//
+func cityRecord(continent, country string, lat, lon float64) map[string]interface{} {
+	record := countryRecord(continent, country)
+	record["location"] = map[string]interface{}{
+		"latitude": lat,
+		"longitude": lon,
+	}
+	return record
+}
+
+// Build a country-level record without coordinates.
+//
+func countryRecord(continent, country string) map[string]interface{} {
+	return map[string]interface{}{
+		"continent": map[string]interface{}{ "code": continent },
+		"country": map[string]interface{}{ "iso_code": country },
+	}
+}
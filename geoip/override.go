@@ -0,0 +1,157 @@
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+// A network override that forces the location and/or the preferred
+// mirrors of the matched clients.
+//
+type Override struct {
+	Network		*net.IPNet
+	Location	*Location         // nil if not forced
+	Mirrors		[]*common.Mirror  // empty if not forced
+}
+
+// A binary trie of network prefixes for longest-prefix matching.
+//
+type prefixTrie struct {
+	root	prefixNode
+	count	int
+}
+
+type prefixNode struct {
+	children	[2]*prefixNode
+	value		*Override
+}
+
+// Overrides of IPv4 and IPv6 networks
+var overrides4, overrides6 *prefixTrie
+
+
+// Build the network overrides from the [[override]] config.
+//
+func SetupOverrides() error {
+	trie4, trie6 := &prefixTrie{}, &prefixTrie{}
+	for i, cfg := range appConfig.Overrides {
+		override, err := newOverride(cfg)
+		if err != nil {
+			return fmt.Errorf("Config [override.%d]: %v", i, err)
+		}
+		if len(cfg.Networks) == 0 {
+			return fmt.Errorf("Config [override.%d]: no networks", i)
+		}
+
+		for _, cidr := range cfg.Networks {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("Config [override.%d]: %v", i, err)
+			}
+			o := *override
+			o.Network = ipnet
+			if len(ipnet.Mask) == net.IPv4len {
+				trie4.insert(ipnet, &o)
+			} else {
+				trie6.insert(ipnet, &o)
+			}
+		}
+	}
+
+	overrides4, overrides6 = trie4, trie6
+	if n := trie4.count + trie6.count; n > 0 {
+		common.InfoPrintf("Loaded %d network overrides.\n", n)
+	}
+	return nil
+}
+
+func newOverride(cfg *common.OverrideConfig) (*Override, error) {
+	override := &Override{}
+	if cfg.CountryCode != "" || cfg.ContinentCode != "" {
+		if cfg.CountryCode == "" || cfg.ContinentCode == "" {
+			return nil, fmt.Errorf("location incomplete")
+		}
+		override.Location = &Location{
+			ContinentCode: strings.ToUpper(cfg.ContinentCode),
+			CountryCode: strings.ToUpper(cfg.CountryCode),
+			Latitude: cfg.Latitude,
+			Longitude: cfg.Longitude,
+		}
+	}
+
+	for _, name := range cfg.Mirrors {
+		mirror, ok := appConfig.Mirrors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown mirror: %s", name)
+		}
+		override.Mirrors = append(override.Mirrors, mirror)
+	}
+
+	if override.Location == nil && len(override.Mirrors) == 0 {
+		return nil, fmt.Errorf("neither location nor mirrors set")
+	}
+	return override, nil
+}
+
+
+// Find the override of the longest network prefix matching the IP.
+//
+func LookupOverride(ip net.IP) *Override {
+	if ip4 := ip.To4(); ip4 != nil {
+		return overrides4.lookup(ip4)
+	}
+	return overrides6.lookup(ip.To16())
+}
+
+
+// Insert the network into the trie; a duplicate replaces the old one.
+//
+func (t *prefixTrie) insert(ipnet *net.IPNet, value *Override) {
+	ip := ipnet.IP.To16()
+	if len(ipnet.Mask) == net.IPv4len {
+		ip = ipnet.IP.To4()
+	}
+	ones, _ := ipnet.Mask.Size()
+
+	node := &t.root
+	for i := 0; i < ones; i++ {
+		bit := ipBit(ip, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &prefixNode{}
+		}
+		node = node.children[bit]
+	}
+	if node.value == nil {
+		t.count++
+	}
+	node.value = value
+}
+
+// Walk down the trie along the IP bits and return the value of the
+// deepest (i.e., longest) matching prefix.
+//
+func (t *prefixTrie) lookup(ip net.IP) *Override {
+	if t == nil || ip == nil {
+		return nil
+	}
+
+	node := &t.root
+	match := node.value
+	for i := 0; i < len(ip) * 8; i++ {
+		node = node.children[ipBit(ip, i)]
+		if node == nil {
+			break
+		}
+		if node.value != nil {
+			match = node.value
+		}
+	}
+	return match
+}
+
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i/8] >> (7 - uint(i%8))) & 1
+}
@@ -0,0 +1,127 @@
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+
+func TestPrefixTrie(t *testing.T) {
+	trie := &prefixTrie{}
+	insert := func(cidr string) {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trie.insert(ipnet, &Override{ Network: ipnet })
+	}
+
+	insert("10.0.0.0/8")
+	insert("10.1.0.0/16")
+	insert("10.1.2.0/24")
+	insert("10.1.2.3/32")
+	// Thousands of unrelated networks
+	for i := 0; i < 4096; i++ {
+		insert(fmt.Sprintf("172.%d.%d.0/24", 16 + i/256, i%256))
+	}
+
+	cases := []struct {
+		ip string
+		want string  // matched network; empty for no match
+	}{
+		{ "10.1.2.3", "10.1.2.3/32" },
+		{ "10.1.2.4", "10.1.2.0/24" },
+		{ "10.1.3.1", "10.1.0.0/16" },
+		{ "10.2.0.1", "10.0.0.0/8" },
+		{ "11.0.0.1", "" },
+		{ "172.16.0.1", "172.16.0.0/24" },
+		{ "172.31.255.254", "172.31.255.0/24" },
+		{ "172.32.0.1", "" },
+	}
+	for _, tc := range cases {
+		o := trie.lookup(net.ParseIP(tc.ip).To4())
+		got := ""
+		if o != nil {
+			got = o.Network.String()
+		}
+		if got != tc.want {
+			t.Errorf("lookup(%s) = %q, want %q", tc.ip, got, tc.want)
+		}
+	}
+	if trie.count != 4 + 4096 {
+		t.Errorf("count = %d, want %d", trie.count, 4 + 4096)
+	}
+}
+
+
+func TestOverrides(t *testing.T) {
+	saved := appConfig.Overrides
+	defer func() {
+		appConfig.Overrides = saved
+		SetupOverrides()
+	}()
+
+	appConfig.Overrides = []*common.OverrideConfig{
+		{
+			// University network wrongly located
+			Networks: []string{ "199.233.0.0/16" },
+			ContinentCode: "as",
+			CountryCode: "cn",
+			Latitude: 31.2,
+			Longitude: 121.4,
+		},
+		{
+			// Our own datacenter, served by our own mirror
+			Networks: []string{ "199.233.90.0/24", "2001:470::/32" },
+			Mirrors: []string{ "dfly_avalon" },
+		},
+	}
+	if err := SetupOverrides(); err != nil {
+		t.Fatalf("SetupOverrides() failed: %v", err)
+	}
+
+	// Forced location
+	loc, err := LookupIP(net.ParseIP("199.233.1.1"))
+	if loc == nil || loc.CountryCode != "CN" || loc.ContinentCode != "AS" ||
+	   loc.Latitude != 31.2 || loc.Override == nil {
+		t.Errorf("LookupIP() = (%+v, %v), want forced CN location", loc, err)
+	}
+	mirrors, tier := FindMirrors(loc)
+	if tier != TierCountry || mirrors[0].Name != "SJTUG" {
+		t.Errorf("FindMirrors(%+v) = (%v, %s), want SJTUG by country",
+				loc, mirrors, tier)
+	}
+
+	// Forced mirrors (the longer prefix wins)
+	for _, ipstr := range []string{ "199.233.90.68", "2001:470:1:43b:1::68" } {
+		loc, _ := LookupIP(net.ParseIP(ipstr))
+		if loc == nil || loc.Override == nil {
+			t.Errorf("LookupIP(%s) = %+v, want override", ipstr, loc)
+			continue
+		}
+		mirrors, tier := FindMirrors(loc)
+		if tier != TierOverride || len(mirrors) != 2 ||
+		   mirrors[0].Name != "DragonFly/Avalon" ||
+		   mirrors[1].Name != "SJTUG" {
+			t.Errorf("FindMirrors(%+v) = (%v, %s), want override",
+					loc, mirrors, tier)
+		}
+	}
+
+	invalid := [][]*common.OverrideConfig{
+		{ { Networks: []string{ "10.0.0.0/33" }, Mirrors: []string{ "sjtug" } } },
+		{ { Networks: []string{ "10.0.0.0/8" }, Mirrors: []string{ "nope" } } },
+		{ { Networks: []string{ "10.0.0.0/8" }, CountryCode: "DE" } },
+		{ { Networks: []string{ "10.0.0.0/8" } } },
+		{ { Mirrors: []string{ "sjtug" } } },
+	}
+	for _, cfg := range invalid {
+		appConfig.Overrides = cfg
+		if err := SetupOverrides(); err == nil {
+			t.Errorf("SetupOverrides(%+v) succeeded, want error", *cfg[0])
+		}
+	}
+}
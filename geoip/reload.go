@@ -0,0 +1,44 @@
+package geoip
+
+import (
+	"time"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+
+// Periodically check whether the MMDB files have been replaced
+// (e.g., by a monthly update) and reload them.
+//
+func WatchMMDBs() {
+	interval := appConfig.MMDBCheckInterval * time.Second
+	if interval <= 0 {
+		common.InfoPrintf("MMDB change watcher disabled.\n")
+		return
+	}
+
+	common.InfoPrintf("Watch MMDB changes every %v.\n", interval)
+	for {
+		time.Sleep(interval)
+		ReloadMMDBs(false)
+	}
+}
+
+// Reload the MMDB files that changed, or all of them if force is true
+// (e.g., upon SIGHUP).
+//
+func ReloadMMDBs(force bool) {
+	for _, mmdb := range appConfig.AllMMDBs() {
+		if !force && !mmdb.Changed() {
+			continue
+		}
+
+		entry := common.WithFields(common.Fields{ "mmdb": mmdb.File })
+		if err := mmdb.Reload(); err != nil {
+			entry.Errorf("Failed to reload MMDB (%s): %v\n",
+					mmdb.File, err)
+			continue
+		}
+		entry.Infof("Reloaded MMDB: %s\n", mmdb.File)
+	}
+}
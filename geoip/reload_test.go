@@ -0,0 +1,93 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+
+func TestReloadMMDBs(t *testing.T) {
+	path := writeMMDB(t, "City", []mmdbEntry{
+		{ "192.0.2.0/24", cityRecord("EU", "FR", 48.85, 2.35) },
+	})
+	mmdb := &common.MMDBConfig{
+		File: path,
+		Family: "any",
+		TestIP: "192.0.2.1",
+	}
+	if err := mmdb.Reload(); err != nil {
+		t.Fatalf("Reload() failed: %v", err)
+	}
+	defer func() { mmdb.DB.Close() }()
+
+	saved := appConfig.MMDB
+	defer func() { appConfig.MMDB = saved }()
+	appConfig.MMDB = []*common.MMDBConfig{ mmdb }
+
+	ip := net.ParseIP("192.0.2.1")
+	assertCountry := func(want string) {
+		t.Helper()
+		loc, err := LookupIP(ip)
+		if loc == nil || loc.CountryCode != want {
+			t.Errorf("LookupIP(%v) = (%v, %v), want country %s",
+					ip, loc, err, want)
+		}
+	}
+	assertCountry("FR")
+
+	if mmdb.Changed() {
+		t.Errorf("Changed() = true for an untouched file")
+	}
+
+	// Replace the file as an updater would do.
+	replace := func(src string) {
+		t.Helper()
+		if err := os.Rename(src, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replace(writeMMDB(t, "City", []mmdbEntry{
+		{ "192.0.2.0/24", cityRecord("AS", "JP", 35.68, 139.69) },
+	}))
+	if !mmdb.Changed() {
+		t.Errorf("Changed() = false for a replaced file")
+	}
+
+	// Lookups in flight during the reload must not fail.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if loc, err := LookupIP(ip); loc == nil {
+					t.Errorf("LookupIP(%v) failed: %v", ip, err)
+					return
+				}
+			}
+		}()
+	}
+	ReloadMMDBs(false)
+	wg.Wait()
+	assertCountry("JP")
+
+	// A database failing the test lookup is not swapped in.
+	replace(writeMMDB(t, "City", []mmdbEntry{
+		{ "198.51.100.0/24", cityRecord("EU", "DE", 52.52, 13.40) },
+	}))
+	if err := mmdb.Reload(); err == nil {
+		t.Errorf("Reload() succeeded; want test lookup failure")
+	}
+	assertCountry("JP")
+
+	// Neither is a corrupted file.
+	garbage := path + ".tmp"
+	os.WriteFile(garbage, []byte("not a MaxMind DB"), 0644)
+	replace(garbage)
+	ReloadMMDBs(true)
+	assertCountry("JP")
+}
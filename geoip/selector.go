@@ -0,0 +1,466 @@
+package geoip
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+// Context of the client requesting the mirrors.
+//
+type Client struct {
+	IP		net.IP
+	Location	*Location  // nil if unknown
+	ABI		string
+	Header		http.Header
+	MinMirrors	int  // including the default; 0 for no minimum
+	MaxMirrors	int  // including the default; 0 for no limit
+}
+
+// A selected mirror and the reason (e.g., the matched tier) why it's
+// selected.
+//
+type Selection struct {
+	Mirror	*common.Mirror
+	Reason	string
+	URL	string  // preferred working URL of the mirror for the client
+}
+
+// A policy to select and order the mirrors for a client.
+//
+// The network overrides and the default mirror as the last fallback are
+// handled by SelectMirrors() for all selectors.
+//
+type Selector interface {
+	// Select from the online mirrors (ordered by name) for the client.
+	Select(client *Client, mirrors []*common.Mirror) []*Selection
+}
+
+// Available selectors by name
+var selectors = map[string]func() Selector{
+	"tier": func() Selector { return &tierSelector{} },
+	"distance": func() Selector { return &distanceSelector{} },
+	"latency": func() Selector { return &latencySelector{} },
+	"throughput": func() Selector { return &throughputSelector{} },
+	"weighted": func() Selector { return newWeightedSelector() },
+	"round-robin": func() Selector { return &roundRobinSelector{} },
+}
+
+// The configured selector
+var selector Selector = &tierSelector{}
+
+
+// Create the selector configured by [selector].
+//
+func SetupSelector() error {
+	name := strings.ToLower(appConfig.Selector)
+	newSelector, ok := selectors[name]
+	if !ok {
+		return fmt.Errorf("Config [selector]: unknown selector: %s",
+				appConfig.Selector)
+	}
+	selector = newSelector()
+	common.InfoPrintf("Mirror selector: %s\n", name)
+	return nil
+}
+
+
+// Select the mirrors for the client with the configured selector.
+//
+func SelectMirrors(client *Client) []*Selection {
+	return selectMirrors(selector, client)
+}
+
+// Select the mirrors with the given selector.
+//
+// Only the mirrors online over the client's address family are selected.
+// The online preferred mirrors of the matched network override are used
+// instead of the selector's, and the default mirror is always appended
+// as the fallback (even if offline).  The online fallback mirrors are
+// put before the default one if the client location is unknown or the
+// default is offline.
+//
+// The selections are then padded with the nearest mirrors of the outer
+// tiers up to the client's minimum, and truncated to the maximum.  The
+// limits count the distinct mirrors: the default mirror is moved to the
+// last if already selected.  The selections are not padded if the client
+// location is unknown, since all the online fallback mirrors are already
+// selected then.
+//
+func selectMirrors(s Selector, client *Client) []*Selection {
+	var m_default *common.Mirror
+	var m_online []*common.Mirror
+	for _, mirror := range appConfig.Mirrors {
+		if mirror.IsDefault {
+			m_default = mirror
+		}
+		if isOnline(mirror, client.IP) {
+			m_online = append(m_online, mirror)
+		}
+	}
+	sort.Slice(m_online, func(i, j int) bool {
+		return m_online[i].Name < m_online[j].Name
+	})
+
+	var selections []*Selection
+	if loc := client.Location; loc != nil && loc.Override != nil {
+		for _, mirror := range loc.Override.Mirrors {
+			if isOnline(mirror, client.IP) {
+				selections = append(selections, &Selection{
+					Mirror: mirror,
+					Reason: TierOverride,
+				})
+			}
+		}
+	}
+	if len(selections) == 0 {
+		selections = s.Select(client, m_online)
+	}
+	if appConfig.Monitor.FlapDemote {
+		selections = demoteFlapping(selections)
+	}
+
+	if client.Location == nil || !isOnline(m_default, client.IP) {
+		selections = appendFallbacks(selections, client.IP)
+	}
+
+	// Keep the reason if the default mirror is selected.
+	last := &Selection{
+		Mirror: m_default,
+		Reason: TierDefault,
+	}
+	var others []*Selection
+	for _, s := range selections {
+		if s.Mirror == m_default {
+			last = s
+		} else {
+			others = append(others, s)
+		}
+	}
+	selections = others
+
+	if n := client.MinMirrors - 1; n > len(selections) &&
+	   client.Location != nil {
+		selections = padSelections(selections, m_online, m_default,
+				client.Location, n)
+	}
+	if n := client.MaxMirrors - 1; n >= 0 && n < len(selections) {
+		selections = selections[:n]
+	}
+
+	selections = append(selections, last)
+	for _, s := range selections {
+		s.URL = preferredURL(s.Mirror, client.IP)
+	}
+	return selections
+}
+
+// Move the flapping mirrors after the stable ones, keeping their order.
+//
+func demoteFlapping(selections []*Selection) []*Selection {
+	var stable, flapping []*Selection
+	for _, s := range selections {
+		if s.Mirror.Status.Flapping {
+			flapping = append(flapping, s)
+		} else {
+			stable = append(stable, s)
+		}
+	}
+	return append(stable, flapping...)
+}
+
+// Whether the mirror is online over the address family of the client IP
+// (or over any family if the IP is unknown), and not disabled or under
+// maintenance via the admin API.
+//
+func isOnline(mirror *common.Mirror, ip net.IP) bool {
+	if mirror.AdminState(time.Now()) != nil {
+		return false
+	}
+	st := &mirror.Status
+	return onlineOver(ip, st.Online, st.Online4, st.Online6)
+}
+
+func onlineOver(ip net.IP, online, online4, online6 bool) bool {
+	switch {
+	case ip == nil:
+		return online
+	case ip.To4() != nil:
+		return online4
+	default:
+		return online6
+	}
+}
+
+// Get the first URL of the mirror that is online over the client's
+// address family, in the order of the [url_schemes] preference; or the
+// main URL if none.
+//
+func preferredURL(mirror *common.Mirror, ip net.IP) string {
+	urls := mirror.PkgURLs()
+	for _, scheme := range appConfig.URLSchemes {
+		for _, rawurl := range urls {
+			u, err := url.Parse(rawurl)
+			st := mirror.Status.URLs[rawurl]
+			if err != nil || st == nil || u.Scheme != scheme {
+				continue
+			}
+			if onlineOver(ip, st.Online, st.Online4, st.Online6) {
+				return rawurl
+			}
+		}
+	}
+	return mirror.URL
+}
+
+// Append the online fallback mirrors that are not yet selected.
+//
+func appendFallbacks(selections []*Selection, ip net.IP) []*Selection {
+	selected := map[*common.Mirror]bool{}
+	for _, s := range selections {
+		selected[s.Mirror] = true
+	}
+	for _, mirror := range appConfig.Fallbacks {
+		if isOnline(mirror, ip) && !selected[mirror] {
+			selections = append(selections, &Selection{
+				Mirror: mirror,
+				Reason: TierFallback,
+			})
+		}
+	}
+	return selections
+}
+
+// Append the not yet selected mirrors (except the default one) of the
+// tiers in order (then the whole world), nearest first, until there are
+// n selections.
+//
+func padSelections(selections []*Selection, mirrors []*common.Mirror,
+		m_default *common.Mirror, location *Location,
+		n int) []*Selection {
+	selected := map[*common.Mirror]bool{ m_default: true }
+	for _, s := range selections {
+		selected[s.Mirror] = true
+	}
+
+	outer := append(append([]string{}, tiers...), TierWorld)
+	for _, name := range outer {
+		match := tierMatchers[name]
+		var matched []*common.Mirror
+		for _, mirror := range mirrors {
+			if !selected[mirror] && match(mirror, location) {
+				matched = append(matched, mirror)
+			}
+		}
+		sort.SliceStable(matched, fLess(matched, location))
+		for _, mirror := range matched {
+			if len(selections) >= n {
+				return selections
+			}
+			selections = append(selections, &Selection{
+				Mirror: mirror,
+				Reason: name,
+			})
+			selected[mirror] = true
+		}
+	}
+	return selections
+}
+
+// Get the mirrors of the selections.
+//
+func SelectedMirrors(selections []*Selection) []*common.Mirror {
+	mirrors := make([]*common.Mirror, 0, len(selections))
+	for _, s := range selections {
+		mirrors = append(mirrors, s.Mirror)
+	}
+	return mirrors
+}
+
+
+// The default selector that takes the mirrors of the first matched tier
+// (see [tiers]), ordered by distance.
+//
+type tierSelector struct{}
+
+func (s *tierSelector) Select(client *Client,
+		mirrors []*common.Mirror) []*Selection {
+	if client.Location == nil {
+		return nil
+	}
+	return findTierMirrors(mirrors, client.Location)
+}
+
+
+// Select all the mirrors ordered by distance, regardless of the tiers.
+//
+type distanceSelector struct{}
+
+func (s *distanceSelector) Select(client *Client,
+		mirrors []*common.Mirror) []*Selection {
+	if client.Location == nil {
+		return nil
+	}
+	sorted := append([]*common.Mirror{}, mirrors...)
+	sort.SliceStable(sorted, fLess(sorted, client.Location))
+	return newSelections(sorted, "distance")
+}
+
+
+// Select the mirrors of the first matched tier, ordered by the latency
+// measured by the monitor instead of distance.  Mirrors without a
+// measured latency go last.
+//
+type latencySelector struct{}
+
+func (s *latencySelector) Select(client *Client,
+		mirrors []*common.Mirror) []*Selection {
+	selections := tierSelections(client, mirrors)
+	latency := func(i int) int64 {
+		if l := selections[i].Mirror.Status.Latency; l > 0 {
+			return l
+		}
+		return math.MaxInt64
+	}
+	sortGroups(selections, func(i, j int) bool {
+		return latency(i) < latency(j)
+	})
+	return selections
+}
+
+
+// Select the mirrors of the first matched tier, ordered by the download
+// throughput measured by the monitor (highest first); the mirrors
+// without a measured throughput go last.
+//
+type throughputSelector struct{}
+
+func (s *throughputSelector) Select(client *Client,
+		mirrors []*common.Mirror) []*Selection {
+	selections := tierSelections(client, mirrors)
+	sortGroups(selections, func(i, j int) bool {
+		return selections[i].Mirror.Status.Throughput >
+				selections[j].Mirror.Status.Throughput
+	})
+	return selections
+}
+
+
+// Select the mirrors of the first matched tier, randomly ordered with
+// the probability of going first proportional to the mirror weight.
+//
+type weightedSelector struct {
+	mu	sync.Mutex
+	rand	*rand.Rand
+}
+
+func newWeightedSelector() *weightedSelector {
+	return &weightedSelector{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *weightedSelector) Select(client *Client,
+		mirrors []*common.Mirror) []*Selection {
+	selections := tierSelections(client, mirrors)
+
+	// Weighted random sampling (Efraimidis & Spirakis, 2006)
+	keys := map[*Selection]float64{}
+	s.mu.Lock()
+	for _, sel := range selections {
+		w := float64(sel.Mirror.Weight)
+		if w <= 0 {
+			w = 1
+		}
+		keys[sel] = math.Pow(s.rand.Float64(), 1 / w)
+	}
+	s.mu.Unlock()
+
+	sortGroups(selections, func(i, j int) bool {
+		return keys[selections[i]] > keys[selections[j]]
+	})
+	return selections
+}
+
+
+// Select the mirrors of the first matched tier and rotate them on each
+// request to spread the load.
+//
+type roundRobinSelector struct {
+	counter	uint64
+}
+
+func (s *roundRobinSelector) Select(client *Client,
+		mirrors []*common.Mirror) []*Selection {
+	selections := tierSelections(client, mirrors)
+	n := atomic.AddUint64(&s.counter, 1) - 1
+
+	result := make([]*Selection, 0, len(selections))
+	for _, group := range groupSelections(selections) {
+		k := int(n % uint64(len(group)))
+		result = append(result, group[k:]...)
+		result = append(result, group[:k]...)
+	}
+	return result
+}
+
+
+// Select the mirrors by tiers; all the online mirrors if the client
+// location is unknown.
+//
+func tierSelections(client *Client, mirrors []*common.Mirror) []*Selection {
+	if client.Location == nil {
+		return newSelections(mirrors, TierWorld)
+	}
+	return findTierMirrors(mirrors, client.Location)
+}
+
+func newSelections(mirrors []*common.Mirror, reason string) []*Selection {
+	selections := make([]*Selection, 0, len(mirrors))
+	for _, m := range mirrors {
+		selections = append(selections, &Selection{
+			Mirror: m,
+			Reason: reason,
+		})
+	}
+	return selections
+}
+
+// Split the selections into the consecutive groups of the same reason.
+//
+func groupSelections(selections []*Selection) [][]*Selection {
+	var groups [][]*Selection
+	start := 0
+	for i := 1; i <= len(selections); i++ {
+		if i == len(selections) ||
+		   selections[i].Reason != selections[start].Reason {
+			groups = append(groups, selections[start:i])
+			start = i
+		}
+	}
+	return groups
+}
+
+// Sort the selections within each group of the same reason, so that the
+// tier order is kept.
+//
+func sortGroups(selections []*Selection, less func(i, j int) bool) {
+	offset := 0
+	for _, group := range groupSelections(selections) {
+		base := offset
+		sort.SliceStable(group, func(i, j int) bool {
+			return less(base + i, base + j)
+		})
+		offset += len(group)
+	}
+}
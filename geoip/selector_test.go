@@ -0,0 +1,497 @@
+package geoip
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+
+// Replace the mirrors for the test and restore them on cleanup.
+//
+func setupSelectorMirrors(t *testing.T) []*common.Mirror {
+	saved := appConfig.Fallbacks
+	t.Cleanup(func() { appConfig.Fallbacks = saved })
+	appConfig.Fallbacks = nil
+
+	mirrors := []*common.Mirror{
+		newTestMirror("Berlin", "EU", "DE", 52.5, 13.4),
+		newTestMirror("Frankfurt", "EU", "DE", 50.1, 8.7),
+		newTestMirror("Munich", "EU", "DE", 48.1, 11.6),
+		newTestMirror("Paris", "EU", "FR", 48.9, 2.4),
+	}
+	for i, latency := range []int64{ 80, 20, 0, 10 } {
+		mirrors[i].Status.Latency = latency
+		mirrors[i].Weight = 1
+	}
+	mirrors[2].Weight = 1000
+	mirrors[3].IsDefault = true
+	setTestMirrors(t, mirrors...)
+	return mirrors
+}
+
+func selectionNames(selections []*Selection) []string {
+	return mirrorNames(SelectedMirrors(selections))
+}
+
+
+func TestSelectors(t *testing.T) {
+	setupSelectorMirrors(t)
+	berlin := newLocation("EU", "DE", 52.5, 13.4)
+
+	cases := []struct {
+		selector Selector
+		location *Location
+		want []string
+		reason string  // of the first selection
+	}{
+		{
+			selector: &tierSelector{},
+			location: berlin,
+			want: []string{ "Berlin", "Frankfurt", "Munich", "Paris" },
+			reason: TierCountry,
+		},
+		{
+			selector: &tierSelector{},
+			location: nil,
+			want: []string{ "Paris" },
+			reason: TierDefault,
+		},
+		{
+			selector: &distanceSelector{},
+			location: berlin,
+			want: []string{ "Berlin", "Frankfurt", "Munich", "Paris" },
+			reason: "distance",
+		},
+		{
+			// Paris is not in the country tier.
+			selector: &latencySelector{},
+			location: berlin,
+			want: []string{ "Frankfurt", "Berlin", "Munich", "Paris" },
+			reason: TierCountry,
+		},
+		{
+			selector: &latencySelector{},
+			location: nil,
+			want: []string{ "Frankfurt", "Berlin", "Munich", "Paris" },
+			reason: TierWorld,
+		},
+	}
+	for _, tc := range cases {
+		selections := selectMirrors(tc.selector, &Client{
+			Location: tc.location,
+		})
+		got := selectionNames(selections)
+		if !sameMirrors(SelectedMirrors(selections), tc.want) ||
+		   selections[0].Reason != tc.reason {
+			t.Errorf("%T.Select(%+v) = (%v, %s), want (%v, %s)",
+					tc.selector, tc.location, got,
+					selections[0].Reason, tc.want, tc.reason)
+		}
+	}
+}
+
+
+func TestRoundRobinSelector(t *testing.T) {
+	setupSelectorMirrors(t)
+	client := &Client{ Location: newLocation("EU", "DE", 52.5, 13.4) }
+	s := &roundRobinSelector{}
+
+	wants := [][]string{
+		{ "Berlin", "Frankfurt", "Munich", "Paris" },
+		{ "Frankfurt", "Munich", "Berlin", "Paris" },
+		{ "Munich", "Berlin", "Frankfurt", "Paris" },
+		{ "Berlin", "Frankfurt", "Munich", "Paris" },
+	}
+	for i, want := range wants {
+		selections := selectMirrors(s, client)
+		if !sameMirrors(SelectedMirrors(selections), want) {
+			t.Errorf("round %d: got %v, want %v",
+					i, selectionNames(selections), want)
+		}
+	}
+}
+
+
+func TestWeightedSelector(t *testing.T) {
+	setupSelectorMirrors(t)
+	client := &Client{ Location: newLocation("EU", "DE", 52.5, 13.4) }
+	s := newWeightedSelector()
+
+	// Munich (weight 1000) vs. Berlin and Frankfurt (weight 1)
+	first := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		selections := selectMirrors(s, client)
+		if len(selections) != 4 || selections[3].Mirror.Name != "Paris" {
+			t.Fatalf("got %v, want 3 mirrors + default",
+					selectionNames(selections))
+		}
+		first[selections[0].Mirror.Name]++
+	}
+	if first["Munich"] < 950 {
+		t.Errorf("Munich selected first %d/1000 times, want >= 950",
+				first["Munich"])
+	}
+}
+
+
+func TestSelectOverride(t *testing.T) {
+	mirrors := setupSelectorMirrors(t)
+	location := newLocation("EU", "DE", 52.5, 13.4)
+	location.Override = &Override{
+		Mirrors: []*common.Mirror{ mirrors[3], mirrors[1] },
+	}
+
+	for name, newSelector := range selectors {
+		selections := selectMirrors(newSelector(), &Client{
+			Location: location,
+		})
+		want := []string{ "Frankfurt", "Paris" }
+		if got := selectionNames(selections); !sameMirrors(
+				SelectedMirrors(selections), want) ||
+		   selections[0].Reason != TierOverride {
+			t.Errorf("selector %s: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+
+func TestSetupSelector(t *testing.T) {
+	saved := appConfig.Selector
+	defer func() {
+		appConfig.Selector = saved
+		SetupSelector()
+	}()
+
+	for name := range selectors {
+		appConfig.Selector = name
+		if err := SetupSelector(); err != nil {
+			t.Errorf("SetupSelector(%q) failed: %v", name, err)
+		}
+	}
+	appConfig.Selector = "random"
+	if err := SetupSelector(); err == nil {
+		t.Errorf("SetupSelector(%q) succeeded, want error", "random")
+	}
+}
+
+
+func TestSelectLimits(t *testing.T) {
+	setupSelectorMirrors(t)
+	lyon := newLocation("EU", "FR", 45.76, 4.84)
+	berlin := newLocation("EU", "DE", 52.5, 13.4)
+
+	cases := []struct {
+		location *Location
+		min, max int
+		want []string
+		reasons []string
+	}{
+		{
+			// The default mirror is not duplicated.
+			location: lyon,
+			want: []string{ "Paris" },
+			reasons: []string{ TierCountry },
+		},
+		{
+			location: lyon,
+			min: 2,
+			want: []string{ "Frankfurt", "Paris" },
+			reasons: []string{ TierSubregion, TierCountry },
+		},
+		{
+			location: lyon,
+			min: 4,
+			want: []string{ "Frankfurt", "Munich", "Berlin", "Paris" },
+			reasons: []string{
+				TierSubregion, TierSubregion, TierSubregion,
+				TierCountry,
+			},
+		},
+		{
+			location: lyon,
+			min: 10,
+			max: 10,
+			want: []string{ "Frankfurt", "Munich", "Berlin", "Paris" },
+			reasons: []string{
+				TierSubregion, TierSubregion, TierSubregion,
+				TierCountry,
+			},
+		},
+		{
+			location: berlin,
+			max: 2,
+			want: []string{ "Berlin", "Paris" },
+			reasons: []string{ TierCountry, TierDefault },
+		},
+		{
+			location: berlin,
+			min: 2,
+			max: 1,
+			want: []string{ "Paris" },
+			reasons: []string{ TierDefault },
+		},
+		{
+			// Not padded without the location
+			location: nil,
+			min: 3,
+			want: []string{ "Paris" },
+			reasons: []string{ TierDefault },
+		},
+	}
+	for _, tc := range cases {
+		selections := selectMirrors(&tierSelector{}, &Client{
+			Location: tc.location,
+			MinMirrors: tc.min,
+			MaxMirrors: tc.max,
+		})
+		reasons := []string{}
+		for _, s := range selections {
+			reasons = append(reasons, s.Reason)
+		}
+		if !sameMirrors(SelectedMirrors(selections), tc.want) ||
+		   strings.Join(reasons, ",") != strings.Join(tc.reasons, ",") {
+			t.Errorf("selectMirrors(%+v, min=%d, max=%d) = (%v, %v), " +
+					"want (%v, %v)", tc.location, tc.min, tc.max,
+					selectionNames(selections), reasons,
+					tc.want, tc.reasons)
+		}
+	}
+}
+
+
+func TestSelectFallbacks(t *testing.T) {
+	mirrors := setupSelectorMirrors(t)
+	berlin, frankfurt, paris := mirrors[0], mirrors[1], mirrors[3]
+	savedTiers := appConfig.Tiers
+	defer func() {
+		appConfig.Tiers = savedTiers
+		SetupTiers()
+	}()
+	appConfig.Fallbacks = []*common.Mirror{ frankfurt, berlin }
+	appConfig.Tiers = []string{ "country" }
+	SetupTiers()
+	tokyo := newLocation("AS", "JP", 35.7, 139.7)
+
+	cases := []struct {
+		location *Location
+		offline []*common.Mirror
+		want []string
+	}{
+		{
+			location: nil,
+			want: []string{ "Frankfurt", "Berlin", "Paris" },
+		},
+		{
+			location: nil,
+			offline: []*common.Mirror{ frankfurt },
+			want: []string{ "Berlin", "Paris" },
+		},
+		{
+			// Default online
+			location: tokyo,
+			want: []string{ "Paris" },
+		},
+		{
+			location: tokyo,
+			offline: []*common.Mirror{ paris },
+			want: []string{ "Frankfurt", "Berlin", "Paris" },
+		},
+		{
+			// Fallbacks not duplicated
+			location: newLocation("EU", "DE", 50.1, 8.7),
+			offline: []*common.Mirror{ paris },
+			want: []string{
+				"Frankfurt", "Munich", "Berlin", "Paris",
+			},
+		},
+	}
+	for _, tc := range cases {
+		for _, m := range tc.offline {
+			m.Status.Online = false
+		}
+		selections := selectMirrors(&tierSelector{}, &Client{
+			Location: tc.location,
+		})
+		if !sameMirrors(SelectedMirrors(selections), tc.want) {
+			t.Errorf("selectMirrors(%+v) with offline %v = %v, want %v",
+					tc.location, mirrorNames(tc.offline),
+					selectionNames(selections), tc.want)
+		}
+		for _, m := range tc.offline {
+			m.Status.Online = true
+		}
+	}
+}
+
+
+func TestSelectFamily(t *testing.T) {
+	mirrors := setupSelectorMirrors(t)
+	for _, m := range mirrors {
+		m.Status.Online4, m.Status.Online6 = true, true
+	}
+	// Broken IPv6 of Berlin; Frankfurt IPv6-only
+	mirrors[0].Status.Online6 = false
+	mirrors[1].Status.Online4 = false
+	location := newLocation("EU", "DE", 52.5, 13.4)
+
+	cases := []struct {
+		ip string
+		want []string
+	}{
+		{ "192.0.2.1", []string{ "Berlin", "Munich", "Paris" } },
+		{ "::ffff:192.0.2.1", []string{ "Berlin", "Munich", "Paris" } },
+		{ "2001:db8::1", []string{ "Frankfurt", "Munich", "Paris" } },
+	}
+	for _, tc := range cases {
+		selections := selectMirrors(&tierSelector{}, &Client{
+			IP: net.ParseIP(tc.ip),
+			Location: location,
+		})
+		if !sameMirrors(SelectedMirrors(selections), tc.want) {
+			t.Errorf("selectMirrors(%s) = %v, want %v", tc.ip,
+					selectionNames(selections), tc.want)
+		}
+	}
+}
+
+
+func TestPreferredURL(t *testing.T) {
+	savedSchemes := appConfig.URLSchemes
+	defer func() { appConfig.URLSchemes = savedSchemes }()
+
+	mirror := &common.Mirror{
+		URL: "http://mirror.example.org/dports/",
+		URLs: []string{
+			"rsync://mirror.example.org/dports/",
+			"ftp://mirror.example.org/dports/",
+			"https://mirror.example.org/dports/",
+		},
+	}
+	mirror.Status.URLs = map[string]*common.URLStatus{}
+	for _, u := range mirror.AllURLs() {
+		mirror.Status.URLs[u] = &common.URLStatus{
+			Online: true,
+			Online4: true,
+			Online6: true,
+		}
+	}
+	https := mirror.Status.URLs["https://mirror.example.org/dports/"]
+	http := mirror.Status.URLs["http://mirror.example.org/dports/"]
+	ipv4, ipv6 := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+
+	cases := []struct {
+		schemes []string
+		ip net.IP
+		setup func()
+		want string
+	}{
+		{
+			schemes: []string{ "https", "http", "ftp" },
+			want: "https://mirror.example.org/dports/",
+		},
+		{
+			schemes: []string{ "ftp", "https" },
+			want: "ftp://mirror.example.org/dports/",
+		},
+		{
+			// Broken TLS endpoint
+			schemes: []string{ "https", "http", "ftp" },
+			setup: func() { https.Online, https.Online4 = false, false },
+			ip: ipv4,
+			want: "http://mirror.example.org/dports/",
+		},
+		{
+			schemes: []string{ "https", "http", "ftp" },
+			ip: ipv6,
+			want: "https://mirror.example.org/dports/",
+		},
+		{
+			// None online of the preferred schemes
+			schemes: []string{ "https", "http" },
+			setup: func() { http.Online, http.Online4 = false, false },
+			ip: ipv4,
+			want: "http://mirror.example.org/dports/",
+		},
+	}
+	for _, tc := range cases {
+		appConfig.URLSchemes = tc.schemes
+		if tc.setup != nil {
+			tc.setup()
+		}
+		if got := preferredURL(mirror, tc.ip); got != tc.want {
+			t.Errorf("preferredURL(%v, %v) = %q, want %q",
+					tc.schemes, tc.ip, got, tc.want)
+		}
+	}
+}
+
+
+func TestSelectFlapping(t *testing.T) {
+	mirrors := setupSelectorMirrors(t)
+	mirrors[0].Status.Flapping = true  // Berlin
+	defer func() { appConfig.Monitor.FlapDemote = false }()
+	location := newLocation("EU", "DE", 52.5, 13.4)
+
+	cases := []struct {
+		demote bool
+		want []string
+	}{
+		{ false, []string{ "Berlin", "Frankfurt", "Munich", "Paris" } },
+		{ true, []string{ "Frankfurt", "Munich", "Berlin", "Paris" } },
+	}
+	for _, tc := range cases {
+		appConfig.Monitor.FlapDemote = tc.demote
+		selections := selectMirrors(&tierSelector{}, &Client{
+			Location: location,
+		})
+		if !sameMirrors(SelectedMirrors(selections), tc.want) {
+			t.Errorf("selectMirrors(demote = %v) = %v, want %v",
+					tc.demote, selectionNames(selections),
+					tc.want)
+		}
+	}
+}
+
+
+func TestThroughputSelector(t *testing.T) {
+	mirrors := setupSelectorMirrors(t)
+	mirrors[0].Status.Throughput = 1 << 20  // Berlin
+	mirrors[2].Status.Throughput = 5 << 20  // Munich
+	location := newLocation("EU", "DE", 52.5, 13.4)
+
+	selections := selectMirrors(&throughputSelector{}, &Client{
+		Location: location,
+	})
+	want := []string{ "Munich", "Berlin", "Frankfurt", "Paris" }
+	if !sameMirrors(SelectedMirrors(selections), want) {
+		t.Errorf("throughputSelector: got %v, want %v",
+				selectionNames(selections), want)
+	}
+}
+
+
+func TestSelectAdminState(t *testing.T) {
+	mirrors := setupSelectorMirrors(t)
+	mirrors[0].Status.Admin = &common.AdminState{  // Berlin
+		State: common.AdminMaintenance,
+	}
+	expired := time.Now().Add(-time.Minute)
+	mirrors[1].Status.Admin = &common.AdminState{  // Frankfurt
+		State: common.AdminDisabled,
+		Until: &expired,
+	}
+	location := newLocation("EU", "DE", 52.5, 13.4)
+
+	selections := selectMirrors(&tierSelector{}, &Client{
+		Location: location,
+	})
+	want := []string{ "Frankfurt", "Munich", "Paris" }
+	if !sameMirrors(SelectedMirrors(selections), want) {
+		t.Errorf("selectMirrors() = %v, want %v",
+				selectionNames(selections), want)
+	}
+}
@@ -0,0 +1,102 @@
+package geoip
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+// Match whether the mirror belongs to the tier of the client location.
+type tierMatcher func(mirror *common.Mirror, location *Location) bool
+
+var tierMatchers = map[string]tierMatcher{
+	TierASN: func(mirror *common.Mirror, location *Location) bool {
+		return location.ASN != 0 && hasASN(mirror, location.ASN)
+	},
+	TierCountry: func(mirror *common.Mirror, location *Location) bool {
+		return mirror.CountryCode == location.CountryCode
+	},
+	TierRegion: func(mirror *common.Mirror, location *Location) bool {
+		return sameRegion(mirror.CountryCode, location.CountryCode)
+	},
+	TierSubregion: func(mirror *common.Mirror, location *Location) bool {
+		s := Subregion(location.CountryCode)
+		return s != "" && s == Subregion(mirror.CountryCode)
+	},
+	TierContinent: func(mirror *common.Mirror, location *Location) bool {
+		return mirror.ContinentCode == location.ContinentCode
+	},
+	TierWorld: func(mirror *common.Mirror, location *Location) bool {
+		return true
+	},
+}
+
+// Selection tiers in the configured order
+var tiers []string
+
+// Country code => names of the configured regions
+var countryRegions map[string][]string
+
+
+// Validate the [tiers] config and build the [[region]] groupings.
+//
+func SetupTiers() error {
+	seen := map[string]bool{}
+	list := []string{}
+	for _, name := range appConfig.Tiers {
+		name = strings.ToLower(name)
+		if _, ok := tierMatchers[name]; !ok {
+			return fmt.Errorf("Config [tiers]: unknown tier: %s", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("Config [tiers]: duplicate tier: %s", name)
+		}
+		seen[name] = true
+		list = append(list, name)
+	}
+	if len(list) == 0 {
+		return fmt.Errorf("Config [tiers]: empty")
+	}
+
+	regions := map[string][]string{}
+	for i, cfg := range appConfig.Regions {
+		if cfg.Name == "" {
+			return fmt.Errorf("Config [region.%d]: no name", i)
+		}
+		if len(cfg.Countries) == 0 {
+			return fmt.Errorf("Config [region.%d]: no countries", i)
+		}
+		for _, cc := range cfg.Countries {
+			cc = strings.ToUpper(cc)
+			regions[cc] = append(regions[cc], cfg.Name)
+		}
+	}
+
+	tiers, countryRegions = list, regions
+	common.InfoPrintf("Selection tiers: %s\n", strings.Join(tiers, ", "))
+	if n := len(appConfig.Regions); n > 0 {
+		common.InfoPrintf("Loaded %d regions.\n", n)
+	}
+	return nil
+}
+
+
+// Whether both countries are grouped in a configured region.
+//
+func sameRegion(cc1, cc2 string) bool {
+	for _, r1 := range countryRegions[cc1] {
+		for _, r2 := range countryRegions[cc2] {
+			if r1 == r2 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Get the names of the configured regions containing the country.
+//
+func Regions(country string) []string {
+	return countryRegions[country]
+}
@@ -0,0 +1,324 @@
+package geoip
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+const (
+	dbipBaseURL	= "https://download.db-ip.com"
+	maxmindBaseURL	= "https://download.maxmind.com"
+
+	// Cap the download size in case of a misbehaving server.
+	maxDownloadSize	= 1 << 30
+)
+
+var errNotFound = errors.New("Not found")
+
+// Checksums of the last downloaded MaxMind archives, to avoid downloading
+// the same archive again.
+var (
+	lastChecksums	= map[string]string{}
+	lastChecksumsMu	sync.Mutex
+)
+
+
+// Periodically download the configured database editions and install
+// them if newer than the current ones.
+//
+func StartUpdater() {
+	cfg := &appConfig.MMDBUpdate
+	if !cfg.Enabled {
+		return
+	}
+
+	common.InfoPrintf("Start MMDB updater (interval: %v).\n",
+			cfg.Interval * time.Second)
+	for {
+		time.Sleep(cfg.Interval * time.Second)
+		for _, mmdb := range appConfig.AllMMDBs() {
+			if mmdb.Edition == "" {
+				continue
+			}
+
+			entry := common.WithFields(common.Fields{
+				"mmdb": mmdb.File,
+				"edition": mmdb.Edition,
+			})
+			updated, err := UpdateMMDB(mmdb, time.Now())
+			if err != nil {
+				entry.Errorf("Failed to update MMDB (%s): %v\n",
+						mmdb.File, err)
+			} else if updated {
+				entry.Infof("Updated MMDB: %s\n", mmdb.File)
+			} else {
+				entry.Debugf("MMDB is up to date: %s\n", mmdb.File)
+			}
+		}
+	}
+}
+
+
+// Download the database edition of the MMDB, verify it, atomically
+// replace the file and reload it.
+//
+// Return false if no newer database is available.
+//
+func UpdateMMDB(mmdb *common.MMDBConfig, now time.Time) (bool, error) {
+	var data []byte
+	var checksum string
+	var err error
+	switch mmdb.Type {
+	case common.MMDB_DBIP:
+		data, err = downloadDBIP(mmdb, now)
+	case common.MMDB_MAXMIND:
+		data, checksum, err = downloadMaxMind(mmdb)
+	default:
+		err = fmt.Errorf("Unknown MMDB type: %d", mmdb.Type)
+	}
+	if err != nil || data == nil {
+		return false, err
+	}
+
+	db, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return false, fmt.Errorf("Invalid MMDB: %v", err)
+	}
+	current := mmdb.Metadata()
+	if t := db.Metadata.DatabaseType; t != current.DatabaseType {
+		return false, fmt.Errorf("MMDB type mismatch: %s != %s",
+				t, current.DatabaseType)
+	}
+	if db.Metadata.BuildEpoch <= current.BuildEpoch {
+		rememberChecksum(mmdb, checksum)
+		return false, nil
+	}
+	if err := mmdb.Verify(db); err != nil {
+		return false, err
+	}
+
+	if err := common.WriteFileAtomic(mmdb.File, data); err != nil {
+		return false, err
+	}
+	if err := mmdb.Reload(); err != nil {
+		return false, err
+	}
+	rememberChecksum(mmdb, checksum)
+	return true, nil
+}
+
+
+// Download the DB-IP Lite database, which is published monthly as
+// "<edition>-YYYY-MM.mmdb.gz"; fallback to the previous month if the
+// current one is not yet available.
+//
+// NOTE: DB-IP publishes no checksum file to verify the download against,
+//       so it's only validated by the gzip framing, the MMDB metadata
+//       and the test lookup in UpdateMMDB().
+//
+func downloadDBIP(mmdb *common.MMDBConfig, now time.Time) ([]byte, error) {
+	// Skip if the current database was built this month.
+	now = now.UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if int64(mmdb.Metadata().BuildEpoch) >= month.Unix() {
+		return nil, nil
+	}
+
+	base := mmdb.UpdateURL
+	if base == "" {
+		base = dbipBaseURL
+	}
+	var body []byte
+	var err error
+	for _, t := range []time.Time{ month, month.AddDate(0, -1, 0) } {
+		u := fmt.Sprintf("%s/free/%s-%s.mmdb.gz",
+				strings.TrimSuffix(base, "/"), mmdb.Edition,
+				t.Format("2006-01"))
+		body, err = download(u)
+		if err != errNotFound {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return readAllLimited(zr)
+}
+
+
+// Download the MaxMind database archive (.tar.gz) and verify its SHA256
+// checksum, which is also returned.
+//
+// Return no data if the archive has the same checksum as the last
+// installed (or skipped as not newer) one.
+//
+func downloadMaxMind(mmdb *common.MMDBConfig) ([]byte, string, error) {
+	base := mmdb.UpdateURL
+	if base == "" {
+		base = maxmindBaseURL
+	}
+	query := url.Values{}
+	query.Set("edition_id", mmdb.Edition)
+	query.Set("license_key", mmdb.LicenseKey)
+	query.Set("suffix", "tar.gz.sha256")
+	u := strings.TrimSuffix(base, "/") + "/app/geoip_download?"
+
+	sumfile, err := download(u + query.Encode())
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to download checksum: %v", err)
+	}
+	// Format: "<sha256>  <filename>"
+	fields := strings.Fields(string(sumfile))
+	if len(fields) == 0 {
+		return nil, "", fmt.Errorf("Invalid checksum file")
+	}
+	checksum := strings.ToLower(fields[0])
+
+	lastChecksumsMu.Lock()
+	last := lastChecksums[mmdb.File]
+	lastChecksumsMu.Unlock()
+	if checksum == last {
+		return nil, "", nil
+	}
+
+	query.Set("suffix", "tar.gz")
+	archive, err := download(u + query.Encode())
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(archive)
+	if hex.EncodeToString(sum[:]) != checksum {
+		return nil, "", fmt.Errorf("Checksum mismatch")
+	}
+
+	data, err := extractMMDB(archive)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, checksum, nil
+}
+
+// Remember the checksum of the MaxMind archive that has been handled,
+// so that it's not downloaded again.
+//
+func rememberChecksum(mmdb *common.MMDBConfig, checksum string) {
+	if checksum == "" {
+		return
+	}
+	lastChecksumsMu.Lock()
+	lastChecksums[mmdb.File] = checksum
+	lastChecksumsMu.Unlock()
+}
+
+// Extract the .mmdb file from the tar.gz archive.
+//
+func extractMMDB(archive []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("No .mmdb file in archive")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg &&
+		   strings.HasSuffix(hdr.Name, ".mmdb") {
+			return readAllLimited(tr)
+		}
+	}
+}
+
+
+// Download the URL and return the response body.
+//
+func download(u string) ([]byte, error) {
+	client := &http.Client{
+		Timeout: appConfig.MMDBUpdate.Timeout * time.Second,
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, redactError(err)
+	}
+	req.Header.Set("User-Agent", appConfig.Monitor.UserAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, redactError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return readAllLimited(resp.Body)
+	case http.StatusNotFound:
+		return nil, errNotFound
+	default:
+		return nil, fmt.Errorf("Status code (%d) != OK", resp.StatusCode)
+	}
+}
+
+// Strip the secret license key from the URL in the error (if any),
+// which would otherwise be logged.
+//
+func redactError(err error) error {
+	uerr, ok := err.(*url.Error)
+	if !ok {
+		return err
+	}
+	return &url.Error{
+		Op: uerr.Op,
+		URL: redactURL(uerr.URL),
+		Err: uerr.Err,
+	}
+}
+
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	query := u.Query()
+	if query.Get("license_key") != "" {
+		query.Set("license_key", "REDACTED")
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+func readAllLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxDownloadSize + 1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxDownloadSize {
+		return nil, fmt.Errorf("Download exceeds %d bytes",
+				maxDownloadSize)
+	}
+	return data, nil
+}
+
@@ -0,0 +1,248 @@
+package geoip
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+
+// Setup an MMDB of the given type and edition with an old database.
+//
+func setupUpdateMMDB(t *testing.T, typ int, dbType string,
+		edition string, baseURL string) *common.MMDBConfig {
+	t.Helper()
+
+	data := buildMMDB(t, dbType, 1700000000, []mmdbEntry{
+		{ "192.0.2.0/24", cityRecord("EU", "FR", 48.85, 2.35) },
+	})
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mmdb := &common.MMDBConfig{
+		File: path,
+		Family: "any",
+		TestIP: "192.0.2.1",
+		Edition: edition,
+		LicenseKey: "secret",
+		UpdateURL: baseURL,
+		Type: typ,
+	}
+	if err := mmdb.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mmdb.DB.Close() })
+	return mmdb
+}
+
+func newerMMDB(t *testing.T, dbType string, built time.Time) []byte {
+	return buildMMDB(t, dbType, uint64(built.Unix()), []mmdbEntry{
+		{ "192.0.2.0/24", cityRecord("AS", "JP", 35.68, 139.69) },
+	})
+}
+
+func assertMMDBCountry(t *testing.T, mmdb *common.MMDBConfig, want string) {
+	t.Helper()
+	var record Record
+	ok, err := mmdb.Lookup(net.ParseIP("192.0.2.1"), &record)
+	if !ok || err != nil || record.Country.Code != want {
+		t.Errorf("Lookup() = (%v, %v, %s), want country %s",
+				ok, err, record.Country.Code, want)
+	}
+}
+
+
+func TestUpdateDBIP(t *testing.T) {
+	september := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	var gzdata bytes.Buffer
+	zw := gzip.NewWriter(&gzdata)
+	zw.Write(newerMMDB(t, "DBIP-City-Lite", september))
+	zw.Close()
+
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/free/dbip-city-lite-2026-09.mmdb.gz":
+			w.Write(gzdata.Bytes())
+		default:
+			// October not yet published
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	mmdb := setupUpdateMMDB(t, common.MMDB_DBIP, "DBIP-City-Lite",
+			"dbip-city-lite", srv.URL)
+
+	now := time.Date(2026, 10, 3, 12, 0, 0, 0, time.UTC)
+	updated, err := UpdateMMDB(mmdb, now)
+	if !updated || err != nil {
+		t.Fatalf("UpdateMMDB() = (%v, %v), want (true, nil)", updated, err)
+	}
+	assertMMDBCountry(t, mmdb, "JP")
+	if mmdb.Changed() {
+		t.Errorf("Changed() = true after update")
+	}
+
+	// Not newer than the installed one.
+	updated, err = UpdateMMDB(mmdb, now)
+	if updated || err != nil {
+		t.Errorf("UpdateMMDB() = (%v, %v), want (false, nil)", updated, err)
+	}
+
+	// Already built in the current month; no download at all.
+	requests = 0
+	updated, err = UpdateMMDB(mmdb, september.AddDate(0, 0, 10))
+	if updated || err != nil || requests != 0 {
+		t.Errorf("UpdateMMDB() = (%v, %v) with %d requests, " +
+				"want (false, nil) without requests",
+				updated, err, requests)
+	}
+}
+
+
+func TestUpdateDBIPTypeMismatch(t *testing.T) {
+	var gzdata bytes.Buffer
+	zw := gzip.NewWriter(&gzdata)
+	zw.Write(newerMMDB(t, "DBIP-Country-Lite", time.Now()))
+	zw.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+		w.Write(gzdata.Bytes())
+	}))
+	defer srv.Close()
+
+	mmdb := setupUpdateMMDB(t, common.MMDB_DBIP, "DBIP-City-Lite",
+			"dbip-city-lite", srv.URL)
+	updated, err := UpdateMMDB(mmdb, time.Now())
+	if updated || err == nil {
+		t.Errorf("UpdateMMDB() = (%v, %v), want error", updated, err)
+	}
+	assertMMDBCountry(t, mmdb, "FR")
+}
+
+
+func TestUpdateMaxMind(t *testing.T) {
+	data := newerMMDB(t, "GeoLite2-City", time.Now())
+	var archive bytes.Buffer
+	zw := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(zw)
+	tw.WriteHeader(&tar.Header{
+		Name: "GeoLite2-City_20261001/",
+		Typeflag: tar.TypeDir,
+		Mode: 0755,
+	})
+	tw.WriteHeader(&tar.Header{
+		Name: "GeoLite2-City_20261001/GeoLite2-City.mmdb",
+		Typeflag: tar.TypeReg,
+		Mode: 0644,
+		Size: int64(len(data)),
+	})
+	tw.Write(data)
+	tw.Close()
+	zw.Close()
+
+	sum := sha256.Sum256(archive.Bytes())
+	checksum := hex.EncodeToString(sum[:])
+	downloads := 0
+	srv := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/app/geoip_download" ||
+		   q.Get("edition_id") != "GeoLite2-City" ||
+		   q.Get("license_key") != "secret" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		switch q.Get("suffix") {
+		case "tar.gz.sha256":
+			w.Write([]byte(checksum +
+					"  GeoLite2-City_20261001.tar.gz\n"))
+		case "tar.gz":
+			downloads++
+			w.Write(archive.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	mmdb := setupUpdateMMDB(t, common.MMDB_MAXMIND, "GeoLite2-City",
+			"GeoLite2-City", srv.URL)
+
+	// Bad checksum
+	good := checksum
+	checksum = "0123"
+	updated, err := UpdateMMDB(mmdb, time.Now())
+	if updated || err == nil {
+		t.Errorf("UpdateMMDB() = (%v, %v), want checksum error",
+				updated, err)
+	}
+	assertMMDBCountry(t, mmdb, "FR")
+
+	// Failed verification is retried with the same archive.
+	checksum = good
+	mmdb.TestIP = "198.51.100.1"
+	updated, err = UpdateMMDB(mmdb, time.Now())
+	if updated || err == nil {
+		t.Errorf("UpdateMMDB() = (%v, %v), want verification error",
+				updated, err)
+	}
+	mmdb.TestIP = "192.0.2.1"
+
+	downloads = 0
+	updated, err = UpdateMMDB(mmdb, time.Now())
+	if !updated || err != nil || downloads != 1 {
+		t.Fatalf("UpdateMMDB() = (%v, %v) with %d downloads, " +
+				"want (true, nil) with a download",
+				updated, err, downloads)
+	}
+	assertMMDBCountry(t, mmdb, "JP")
+
+	// Same archive is not downloaded again.
+	downloads = 0
+	updated, err = UpdateMMDB(mmdb, time.Now())
+	if updated || err != nil || downloads != 0 {
+		t.Errorf("UpdateMMDB() = (%v, %v) with %d downloads, " +
+				"want (false, nil) without downloads",
+				updated, err, downloads)
+	}
+}
+
+
+func TestUpdateMaxMindRedactKey(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {}))
+	mmdb := setupUpdateMMDB(t, common.MMDB_MAXMIND, "GeoLite2-City",
+			"GeoLite2-City", srv.URL)
+	// Fail to connect
+	srv.Close()
+
+	updated, err := UpdateMMDB(mmdb, time.Now())
+	if updated || err == nil {
+		t.Fatalf("UpdateMMDB() = (%v, %v), want error", updated, err)
+	}
+	if strings.Contains(err.Error(), mmdb.LicenseKey) {
+		t.Errorf("UpdateMMDB() error leaks the license key: %v", err)
+	}
+	if !strings.Contains(err.Error(), "license_key=REDACTED") {
+		t.Errorf("UpdateMMDB() error = %v, want the redacted URL", err)
+	}
+}
@@ -43,12 +43,15 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"os/user"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/DragonFlyBSD/mirrorselect/api"
 	"github.com/DragonFlyBSD/mirrorselect/common"
+	"github.com/DragonFlyBSD/mirrorselect/geoip"
 	"github.com/DragonFlyBSD/mirrorselect/monitor"
 )
 
@@ -73,6 +76,18 @@ func main() {
 	}
 
 	cfg := common.ReadConfig(cfgfile)
+	if err := geoip.SetupOverrides(); err != nil {
+		common.Fatalf("Failed to setup overrides: %v\n", err)
+	}
+	if err := geoip.SetupTiers(); err != nil {
+		common.Fatalf("Failed to setup tiers: %v\n", err)
+	}
+	if err := geoip.SetupSelector(); err != nil {
+		common.Fatalf("Failed to setup selector: %v\n", err)
+	}
+	if err := monitor.CheckMirrorURLs(); err != nil {
+		common.Fatalf("%v\n", err)
+	}
 
 	gin.SetMode(gin.ReleaseMode)
 	if cfg.Debug {
@@ -80,8 +95,7 @@ func main() {
 	}
 
 	if accesslog != "" {
-		f, err := os.OpenFile(accesslog,
-				os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		f, err := common.OpenLogFile(accesslog)
 		if err != nil {
 			common.Fatalf("Failed to open access log: %v\n", err)
 		}
@@ -90,16 +104,48 @@ func main() {
 		common.InfoPrintf("Write access log to file: %s\n", accesslog)
 	}
 
-	router := gin.Default()
+	router := gin.New()
+	router.Use(gin.LoggerWithFormatter(api.AccessLogFormatter))
+	router.Use(gin.Recovery())
 	router.GET("/", api.GetPing)
 	router.GET("/pkg/:abi/*path", api.GetPkgMirrors)
 	router.GET("/mirror", api.GetMirrors)
 	router.GET("/mirrors", api.GetMirrors)
 	router.GET("/ip", api.GetIP)
+	router.GET("/metrics", api.GetMetrics)
 	router.GET("/ping", api.GetPing)
+	if cfg.Admin.Token != "" {
+		admin := router.Group("/admin", api.AdminAuth)
+		admin.PUT("/mirrors/:name", api.PutAdminState)
+		admin.DELETE("/mirrors/:name", api.DeleteAdminState)
+		common.InfoPrintf("Admin API enabled.\n")
+	}
 
 	go monitor.StartMonitor()
+	go geoip.WatchMMDBs()
+	go geoip.StartUpdater()
+	go handleSignals()
 
 	common.InfoPrintf("Listen on: [%s]\n", cfg.Listen)
 	router.Run(cfg.Listen)
 }
+
+
+// Handle the signals sent to the daemon.
+//
+// - SIGHUP: reload the MMDB files
+// - SIGUSR1: reopen the log files (e.g., after rotated by newsyslog)
+//
+func handleSignals() {
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGHUP, syscall.SIGUSR1)
+	for sig := range sigch {
+		common.InfoPrintf("Received signal: %v\n", sig)
+		switch sig {
+		case syscall.SIGHUP:
+			geoip.ReloadMMDBs(true)
+		case syscall.SIGUSR1:
+			common.ReopenLogFiles()
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package monitor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+// Mirror event of a certificate expiring within the warning window
+const eventCertExpiring = "CERT_EXPIRING"
+
+
+// Interval to repeat the warning of an expiring certificate
+const certWarnInterval = 24 * time.Hour
+
+// Certificate chains seen by the HTTPS checks, by address (host:port),
+// taken by checkCerts() to save another TLS handshake.
+var (
+	checkedCertsMu	sync.Mutex
+	checkedCerts	= map[string]*common.CertStatus{}
+)
+
+
+// Get the address (host:port) of the HTTPS URL.
+//
+func certAddr(u *url.URL) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return u.Host
+}
+
+// Build the certificate status of the peer certificates, or nil if none.
+//
+func newCertStatus(certs []*x509.Certificate) *common.CertStatus {
+	if len(certs) == 0 {
+		return nil
+	}
+	cs := &common.CertStatus{}
+	for _, cert := range certs {
+		cs.Chain = append(cs.Chain, common.CertInfo{
+			Subject: cert.Subject.String(),
+			Issuer: cert.Issuer.String(),
+			NotAfter: cert.NotAfter,
+			DNSNames: cert.DNSNames,
+		})
+		if cs.NotAfter.IsZero() || cert.NotAfter.Before(cs.NotAfter) {
+			cs.NotAfter = cert.NotAfter
+		}
+	}
+	return cs
+}
+
+// Record the certificate chain of the TLS connection of an HTTPS check.
+//
+func recordCerts(u *url.URL, state *tls.ConnectionState) {
+	if state == nil {
+		return
+	}
+	if cs := newCertStatus(state.PeerCertificates); cs != nil {
+		checkedCertsMu.Lock()
+		checkedCerts[certAddr(u)] = cs
+		checkedCertsMu.Unlock()
+	}
+}
+
+// Take the certificate chain recorded by the HTTPS checks of the URL, or
+// nil if none.
+//
+func takeCerts(u *url.URL) *common.CertStatus {
+	checkedCertsMu.Lock()
+	defer checkedCertsMu.Unlock()
+	addr := certAddr(u)
+	cs := checkedCerts[addr]
+	delete(checkedCerts, addr)
+	return cs
+}
+
+// Fetch the certificate chain of the given HTTPS URL with a TLS
+// handshake.  The chain is not verified here (see tls_verify), so that
+// the details of an invalid certificate are also available.
+//
+func fetchCerts(u *url.URL, timeout time.Duration) (*common.CertStatus, error) {
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("Invalid HTTPS URL: %v", u.String())
+	}
+
+	addr := certAddr(u)
+	dialer := &net.Dialer{
+		Timeout: timeout,
+	}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName: u.Hostname(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	cs := newCertStatus(conn.ConnectionState().PeerCertificates)
+	if cs == nil {
+		return nil, fmt.Errorf("No certificates from %s", addr)
+	}
+	return cs, nil
+}
+
+
+// Check the certificates of the HTTPS URLs of the mirror and update its
+// warning state; notify once a certificate enters the warning window.
+//
+// The chains seen by the preceding HTTPS checks are used, and only
+// fetched again if the checks got none (e.g., failed to verify).  The
+// warning of an expiring certificate is logged when it enters the window
+// and then once a day.
+//
+func checkCerts(name string, mirror *common.Mirror, now time.Time) {
+	window := time.Duration(appConfig.Monitor.CertWarning) * 24 * time.Hour
+	expiring := false
+	for _, rawurl := range mirror.AllURLs() {
+		u, err := url.Parse(rawurl)
+		st := mirror.Status.URLs[rawurl]
+		if err != nil || u.Scheme != "https" || st == nil {
+			continue
+		}
+
+		prev := st.Cert
+		cs := takeCerts(u)
+		if cs == nil {
+			cs, err = fetchCerts(u, checkConfig(mirror).Timeout)
+		}
+		if err != nil {
+			// Keep the last known chain.
+			if st.Cert == nil {
+				st.Cert = &common.CertStatus{}
+			}
+			st.Cert.Error = err.Error()
+			common.WithFields(common.Fields{
+				"mirror": name,
+				"url": rawurl,
+				"error": err,
+			}).Debugf("Mirror [%s] URL (%s) certificate check " +
+					"failed: %v\n", name, rawurl, err)
+		} else {
+			if prev != nil {
+				cs.Warned = prev.Warned
+			}
+			st.Cert = cs
+		}
+		if st.Cert.NotAfter.IsZero() {
+			continue
+		}
+
+		wasExpiring := prev != nil && prev.Expiring
+		st.Cert.Expiring = window > 0 &&
+				st.Cert.NotAfter.Sub(now) < window
+		if !st.Cert.Expiring {
+			continue
+		}
+		expiring = true
+		if !wasExpiring || now.Sub(st.Cert.Warned) >= certWarnInterval {
+			st.Cert.Warned = now
+			common.WithFields(common.Fields{
+				"mirror": name,
+				"url": rawurl,
+				"not_after": st.Cert.NotAfter.Format(time.RFC3339),
+			}).Warnf("Mirror [%s] URL (%s) certificate expires " +
+					"at %v!\n", name, rawurl, st.Cert.NotAfter)
+		}
+	}
+
+	if expiring && !mirror.Status.CertExpiring {
+		go notifyExec(name, eventCertExpiring)
+	} else if !expiring && mirror.Status.CertExpiring {
+		common.WithFields(common.Fields{
+			"mirror": name,
+		}).Infof("Mirror [%s] certificates renewed.\n", name)
+	}
+	mirror.Status.CertExpiring = expiring
+}
@@ -0,0 +1,98 @@
+package monitor
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+// Check the URL to determine whether it's accessible over the network
+// ("tcp4" or "tcp6"), with the monitor settings of the mirror.
+type CheckFunc func(u *url.URL, network string,
+		cfg *common.CheckConfig) (bool, error)
+
+// Registered checkers by URL scheme
+var checkers = map[string]CheckFunc{}
+
+
+func init() {
+	RegisterChecker("http", httpCheck)
+	RegisterChecker("https", httpCheck)
+	RegisterChecker("ftp", ftpCheck)
+	RegisterChecker("rsync", rsyncCheck)
+	RegisterChecker("tcp", tcpCheck)
+}
+
+
+// Register the check function for the URL scheme, replacing the
+// existing one if any.
+//
+func RegisterChecker(scheme string, f CheckFunc) {
+	checkers[scheme] = f
+}
+
+// Get the check function for the URL scheme.
+//
+func getChecker(scheme string) (CheckFunc, error) {
+	f, ok := checkers[scheme]
+	if !ok {
+		return nil, fmt.Errorf("No checker for URL scheme: %s", scheme)
+	}
+	return f, nil
+}
+
+// Get the URL schemes that have a checker.
+//
+func Schemes() []string {
+	schemes := make([]string, 0, len(checkers))
+	for scheme := range checkers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+
+// Verify that all the mirror URLs can be checked.
+//
+func CheckMirrorURLs() error {
+	for name, mirror := range appConfig.Mirrors {
+		for _, rawurl := range append([]string{ mirror.URL },
+				mirror.URLs...) {
+			u, err := url.Parse(rawurl)
+			if err != nil {
+				return fmt.Errorf("Mirror [%s] URL invalid: %v",
+						name, err)
+			}
+			if _, err := getChecker(u.Scheme); err != nil {
+				return fmt.Errorf("Mirror [%s] URL (%s): %v",
+						name, rawurl, err)
+			}
+		}
+	}
+	return nil
+}
+
+
+// Check the given tcp://host:port URL by connecting to it.
+//
+func tcpCheck(u *url.URL, network string,
+		cfg *common.CheckConfig) (bool, error) {
+	if u.Scheme != "tcp" {
+		return false, fmt.Errorf("Invalid TCP URL: %v", u.String())
+	}
+	if u.Port() == "" {
+		return false, fmt.Errorf("No port in TCP URL: %v", u.String())
+	}
+
+	conn, err := net.DialTimeout(network, u.Host, cfg.Timeout)
+	if err != nil {
+		return false, err
+	}
+	conn.Close()
+
+	return true, nil
+}
@@ -0,0 +1,54 @@
+package monitor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+
+// Check the content read from the checked path against the expected
+// substring, regex and/or SHA256 checksum.
+//
+// At most 'max_bytes' are read, so that a large file is not downloaded
+// as a whole; the substring and regex are matched against the read part,
+// while the checksum requires the complete content.
+//
+func checkContent(r io.Reader, cfg *common.CheckConfig) error {
+	data, err := io.ReadAll(io.LimitReader(r, cfg.MaxBytes + 1))
+	if err != nil {
+		return err
+	}
+	truncated := int64(len(data)) > cfg.MaxBytes
+	if truncated {
+		data = data[:cfg.MaxBytes]
+	}
+
+	if cfg.Expect != "" && !bytes.Contains(data, []byte(cfg.Expect)) {
+		return fmt.Errorf("Content does not contain %q", cfg.Expect)
+	}
+	if cfg.ExpectRegex != "" {
+		if cfg.ExpectRe == nil {
+			return fmt.Errorf("expect_regex not compiled")
+		}
+		if !cfg.ExpectRe.Match(data) {
+			return fmt.Errorf("Content does not match /%s/",
+					cfg.ExpectRegex)
+		}
+	}
+	if cfg.ExpectSHA256 != "" {
+		if truncated {
+			return fmt.Errorf("Content exceeds %d bytes to checksum",
+					cfg.MaxBytes)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != cfg.ExpectSHA256 {
+			return fmt.Errorf("Content SHA256 mismatch")
+		}
+	}
+	return nil
+}
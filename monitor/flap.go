@@ -0,0 +1,89 @@
+package monitor
+
+import (
+	"math"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+// Mirror events of starting and stopping flapping
+const (
+	eventFlappingStart	= "FLAPPING_START"
+	eventFlappingStop	= "FLAPPING_STOP"
+)
+
+
+// Record the check result of the mirror and detect whether it's
+// flapping, i.e., its state changes too often over the recent checks.
+//
+// Similar to Nagios, the state-change rate is the percentage of the
+// changes between the consecutive results in the window, with the recent
+// changes weighted more (from 0.8 to 1.2); the mirror starts flapping
+// once the rate reaches the high threshold, and stops once it falls
+// below the low threshold.
+//
+// The flapping events are only notified if [monitor.flap_notify] is set,
+// so that the existing notify_exec hooks only get the DOWN/UP events.
+//
+func updateFlapping(name string, mirror *common.Mirror, status bool) {
+	cfg := &appConfig.Monitor
+	st := &mirror.Status
+	if cfg.FlapWindow <= 0 {
+		return
+	}
+
+	st.History = append(st.History, status)
+	if n := len(st.History) - cfg.FlapWindow; n > 0 {
+		st.History = st.History[n:]
+	}
+	st.FlapRate = flapRate(st.History, cfg.FlapWindow)
+
+	event := ""
+	if !st.Flapping && st.FlapRate >= cfg.FlapHigh {
+		st.Flapping = true
+		event = eventFlappingStart
+	} else if st.Flapping && st.FlapRate < cfg.FlapLow {
+		st.Flapping = false
+		event = eventFlappingStop
+	}
+	if event == "" {
+		return
+	}
+
+	entry := common.WithFields(common.Fields{
+		"mirror": name,
+		"event": event,
+		"flap_rate": st.FlapRate,
+	})
+	if st.Flapping {
+		entry.Warnf("Mirror [%s] started flapping (%.1f%% state change).\n",
+				name, st.FlapRate)
+	} else {
+		entry.Infof("Mirror [%s] stopped flapping (%.1f%% state change).\n",
+				name, st.FlapRate)
+	}
+	if cfg.FlapNotify {
+		go notifyExec(name, event)
+	}
+}
+
+// Calculate the weighted state-change rate (in percent) of the results,
+// relative to the full window so that a short history is not considered
+// flapping by a single change.
+//
+func flapRate(history []bool, window int) float64 {
+	if window < 2 {
+		return 0
+	}
+	changes := 0.0
+	for i := 1; i < len(history); i++ {
+		if history[i] == history[i-1] {
+			continue
+		}
+		// Weight by position in the full window: 0.8 (oldest) to
+		// 1.2 (newest).
+		pos := window - len(history) + i - 1
+		changes += 0.8 + 0.4 * float64(pos) / math.Max(float64(window - 2), 1)
+	}
+	return changes * 100 / float64(window - 1)
+}
@@ -0,0 +1,138 @@
+package monitor
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+
+func TestFlapRate(t *testing.T) {
+	cases := []struct {
+		history []bool
+		want float64
+	}{
+		{ []bool{}, 0 },
+		{ []bool{ true, true, true }, 0 },
+		// A single change is not flapping with a short history.
+		{ []bool{ true, false }, 120 / 4.0 },
+		// Recent changes weigh more.
+		{ []bool{ true, false, false, false, false }, 80 / 4.0 },
+		{ []bool{ true, false, true, false, true }, 400 / 4.0 },
+	}
+	for _, tc := range cases {
+		got := flapRate(tc.history, 5)
+		if math.Abs(got - tc.want) > 1e-9 {
+			t.Errorf("flapRate(%v, 5) = %v, want %v",
+					tc.history, got, tc.want)
+		}
+	}
+}
+
+
+func TestUpdateFlapping(t *testing.T) {
+	appConfig.Monitor.Hysteresis = 1
+	appConfig.Monitor.FlapWindow = 11
+	appConfig.Monitor.FlapHigh = 50
+	appConfig.Monitor.FlapLow = 25
+	mirror := &common.Mirror{
+		Status: common.MirrorStatus{
+			Online: true,
+			Online4: true,
+			Online6: true,
+		},
+	}
+
+	status := true
+	for i := 0; i < 10 && !mirror.Status.Flapping; i++ {
+		status = !status
+		updateMirror("test", mirror, status, status)
+	}
+	if !mirror.Status.Flapping {
+		t.Fatalf("updateMirror() failed: not flapping at %.1f%%",
+				mirror.Status.FlapRate)
+	}
+	if len(mirror.Status.History) > 11 {
+		t.Errorf("updateMirror() failed: history of %d > window",
+				len(mirror.Status.History))
+	}
+
+	for i := 0; i < 11 && mirror.Status.Flapping; i++ {
+		updateMirror("test", mirror, true, true)
+	}
+	if mirror.Status.Flapping || !mirror.Status.Online {
+		t.Errorf("updateMirror() failed: flapping = %v (%.1f%%), " +
+				"online = %v; want stable online",
+				mirror.Status.Flapping, mirror.Status.FlapRate,
+				mirror.Status.Online)
+	}
+}
+
+
+func TestFlapNotify(t *testing.T) {
+	// Record the notified events
+	dir := t.TempDir()
+	events := filepath.Join(dir, "events")
+	script := filepath.Join(dir, "notify.sh")
+	err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$2\" >> " +
+			events + "\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := appConfig.Monitor
+	defer func() { appConfig.Monitor = saved }()
+	appConfig.Monitor.NotifyExec = script
+	appConfig.Monitor.ExecTimeout = 5
+	appConfig.Monitor.FlapWindow = 11
+	appConfig.Monitor.FlapHigh = 50
+	appConfig.Monitor.FlapLow = 25
+
+	flap := func() {
+		mirror := &common.Mirror{}
+		status := true
+		for i := 0; i < 11; i++ {
+			status = !status
+			updateFlapping("test", mirror, status)
+		}
+		if !mirror.Status.Flapping {
+			t.Fatalf("updateFlapping() failed: not flapping at %.1f%%",
+					mirror.Status.FlapRate)
+		}
+	}
+
+	// Only the flapping events (the other tests may notify DOWN/UP)
+	flapEvents := func() string {
+		data, _ := os.ReadFile(events)
+		got := ""
+		for _, line := range strings.SplitAfter(string(data), "\n") {
+			if strings.HasPrefix(line, "FLAPPING") {
+				got += line
+			}
+		}
+		return got
+	}
+
+	// Not notified by default
+	flap()
+	time.Sleep(200 * time.Millisecond)
+	if got := flapEvents(); got != "" {
+		t.Errorf("flap_notify = false: notified %q", got)
+	}
+
+	appConfig.Monitor.FlapNotify = true
+	flap()
+	got := ""
+	for i := 0; i < 50 && got == ""; i++ {
+		time.Sleep(100 * time.Millisecond)
+		got = flapEvents()
+	}
+	if got != eventFlappingStart + "\n" {
+		t.Errorf("flap_notify = true: notified %q, want %s",
+				got, eventFlappingStart)
+	}
+}
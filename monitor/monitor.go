@@ -4,9 +4,11 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"os/exec"
+	"strings"
 	"time"
 
 	"github.com/jlaffaye/ftp"
@@ -17,140 +19,334 @@ import (
 
 var appConfig = common.AppConfig
 
+// Address family => network to dial
+var familyNetworks = map[string]string{
+	"ipv4": "tcp4",
+	"ipv6": "tcp6",
+}
+
 
-// Start a monitor that periodically check the status of all mirrors.
+// Start a monitor that periodically check the status of all mirrors,
+// each scheduled on its own.
 //
 func StartMonitor() {
 	common.InfoPrintf("Start mirror monitor.\n")
 
-	var tasks []*workerpool.Task
+	pool := workerpool.NewPool(nil, appConfig.Monitor.Workers)
+	s := newScheduler(pool)
 	for name, mirror := range appConfig.Mirrors {
-		// NOTE: Need to make a copy of the loop variables
-		n := name
-		m := mirror
-		f := func(data interface{}) error {
-			checkMirror(n, m)
-			return nil
-		}
-		tasks = append(tasks, workerpool.NewTask(f, nil))
+		go s.run(name, mirror)
+	}
+	pool.RunBackground()
+}
+
+// Get the monitor settings of the mirror, or the global ones if not set
+// up (e.g., in tests).
+//
+func checkConfig(mirror *common.Mirror) *common.CheckConfig {
+	if mirror.Check != nil {
+		return mirror.Check
+	}
+	return appConfig.Monitor.CheckConfig(nil)
+}
+
+
+// Check each URL of the given mirror over each address family and
+// update its status.
+//
+// The mirror is online if any of its HTTP(S)/FTP URLs is, so that the
+// working ones can still be served.
+//
+func checkMirror(name string, mirror *common.Mirror) {
+	isPkgURL := map[string]bool{}
+	for _, rawurl := range mirror.PkgURLs() {
+		isPkgURL[rawurl] = true
 	}
 
-	pool := workerpool.NewPool(tasks, appConfig.Monitor.Workers)
-	go pool.RunBackground()
+	cfg := checkConfig(mirror)
+	urls := mirror.AllURLs()
+	pkg4, pkg6 := false, false
+	latency := time.Duration(-1)
+	for _, rawurl := range urls {
+		status4, status6, elapsed, err := checkURL(name, rawurl, cfg)
+		st := mirror.Status.URLs[rawurl]
+		if updateURL(st, status4, status6, err) && len(urls) > 1 {
+			entry := common.WithFields(common.Fields{
+				"mirror": name,
+				"url": rawurl,
+				"event": eventName(st.Online),
+			})
+			if st.Online {
+				entry.Infof("Mirror [%s] URL (%s) came UP.\n",
+						name, rawurl)
+			} else {
+				entry.Warnf("Mirror [%s] URL (%s) went DOWN!\n",
+						name, rawurl)
+			}
+		}
 
-	for {
-		time.Sleep(appConfig.Monitor.Interval * time.Second)
-		for i := range tasks {
-			pool.AddTask(tasks[i])
+		if isPkgURL[rawurl] {
+			pkg4 = pkg4 || status4
+			pkg6 = pkg6 || status6
+			if latency < 0 {
+				latency = elapsed
+			}
 		}
 	}
 
-	pool.Stop()
-}
+	if latency >= 0 {
+		mirror.Status.Latency = latency.Milliseconds()
+	}
+	updateMirror(name, mirror, pkg4, pkg6)
 
+	checkCerts(name, mirror, time.Now())
+	probeThroughput(name, mirror, time.Now())
+}
 
-// Check the given mirror and update its status.
+// Check the URL over each configured address family with the checker
+// of its scheme.  The configured check path is resolved against the
+// HTTP(S)/FTP URLs.
 //
-func checkMirror(name string, mirror *common.Mirror) {
-	u, err := url.Parse(mirror.URL)
+// Return the status over IPv4 and IPv6 (an unchecked family is assumed
+// to behave the same as the checked one), the latency of the first OK
+// check (or -1 if none) and the last error.
+//
+func checkURL(name, rawurl string,
+		cfg *common.CheckConfig) (bool, bool, time.Duration, error) {
+	latency := time.Duration(-1)
+	u, err := url.Parse(rawurl)
 	if err != nil {
-		common.Fatalf("Mirror [%s] URL invalid: %v\n",
-				name, mirror.URL)
+		return false, false, latency, err
+	}
+	if cfg.Path != "" && common.IsPkgScheme(u.Scheme) {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" +
+				strings.TrimPrefix(cfg.Path, "/")
+	}
+	check, err := getChecker(u.Scheme)
+	if err != nil {
+		return false, false, latency, err
 	}
 
-	status := false
-	switch u.Scheme {
-	case "http", "https":
-		status, err = httpCheck(u)
-	case "ftp":
-		status, err = ftpCheck(u)
-	default:
-		common.Fatalf("Mirror [%s] URL unsupported: %v\n",
-				name, mirror.URL)
+	var lastErr error
+	results := map[string]bool{}
+	for _, family := range appConfig.Monitor.Families {
+		start := time.Now()
+		status, err := check(u, familyNetworks[family], cfg)
+		elapsed := time.Since(start)
+		common.WithFields(common.Fields{
+			"mirror": name,
+			"url": u.String(),
+			"family": family,
+			"status": status,
+			"latency_ms": elapsed.Milliseconds(),
+			"error": err,
+		}).Debugf("Mirror [%s] (%s, %s): %v, error: %v\n",
+				name, u.String(), family, status, err)
+
+		if status && latency < 0 {
+			latency = elapsed
+		}
+		if err != nil {
+			lastErr = err
+		}
+		results[family] = status
 	}
-	common.DebugPrintf("Mirror [%s]: %v, error: %v\n",
-			name, status, err)
 
-	updateMirror(name, mirror, status)
+	status4, checked4 := results["ipv4"]
+	status6, checked6 := results["ipv6"]
+	if !checked4 {
+		status4 = status6
+	}
+	if !checked6 {
+		status6 = status4
+	}
+	return status4, status6, latency, lastErr
 }
 
 
-// Update the status of a mirror accodring to the check result.
+// Update the status of a URL of a mirror according to the check results.
 //
-func updateMirror(name string, mirror *common.Mirror, status bool) {
+// Return true if its online state changed.
+//
+func updateURL(st *common.URLStatus, status4, status6 bool, err error) bool {
+	st.Error = ""
+	if err != nil {
+		st.Error = err.Error()
+	}
+	applyHysteresis(&st.Online4, &st.Hysteresis4, status4)
+	applyHysteresis(&st.Online6, &st.Hysteresis6, status6)
+	return applyHysteresis(&st.Online, &st.Hysteresis, status4 || status6)
+}
+
+
+// Update the status of a mirror accodring to the check results over
+// IPv4 and IPv6.  The mirror is online if reachable over either of them.
+//
+func updateMirror(name string, mirror *common.Mirror, status4, status6 bool) {
+	status := status4 || status6
 	if status {
 		mirror.Status.OKCount++
 	} else {
 		mirror.Status.ErrorCount++
 	}
+	updateFlapping(name, mirror, status)
+
+	if applyHysteresis(&mirror.Status.Online4,
+			&mirror.Status.Hysteresis4, status4) {
+		common.WithFields(common.Fields{
+			"mirror": name,
+			"family": "ipv4",
+			"event": eventName(status4),
+		}).Infof("Mirror [%s] went %s over IPv4.\n",
+				name, eventName(status4))
+	}
+	if applyHysteresis(&mirror.Status.Online6,
+			&mirror.Status.Hysteresis6, status6) {
+		common.WithFields(common.Fields{
+			"mirror": name,
+			"family": "ipv6",
+			"event": eventName(status6),
+		}).Infof("Mirror [%s] went %s over IPv6.\n",
+				name, eventName(status6))
+	}
 
-	if mirror.Status.Online != status {
-		mirror.Status.Hysteresis++
-		common.DebugPrintf("Mirror [%s] hysteresis = %d\n",
-				name, mirror.Status.Hysteresis)
-		if mirror.Status.Hysteresis >= appConfig.Monitor.Hysteresis {
-			mirror.Status.Hysteresis = 0
-			mirror.Status.Online = status
-			if status {
-				common.InfoPrintf("Mirror [%s] came UP.\n", name)
-			} else {
-				common.WarnPrintf("Mirror [%s] went DOWN!\n", name)
-			}
-			go notifyExec(name, status)
+	if applyHysteresis(&mirror.Status.Online,
+			&mirror.Status.Hysteresis, status) {
+		entry := common.WithFields(common.Fields{
+			"mirror": name,
+			"event": eventName(status),
+			"ok_count": mirror.Status.OKCount,
+			"error_count": mirror.Status.ErrorCount,
+		})
+		if status {
+			entry.Infof("Mirror [%s] came UP.\n", name)
+		} else {
+			entry.Warnf("Mirror [%s] went DOWN!\n", name)
+		}
+		if mirror.Status.Flapping {
+			common.DebugPrintf("Mirror [%s] is flapping; " +
+					"notification suppressed.\n", name)
+		} else {
+			go notifyExec(name, eventName(status))
 		}
-	} else {
-		mirror.Status.Hysteresis = 0
-		common.DebugPrintf("Mirror [%s] hysteresis = %d\n",
-				name, mirror.Status.Hysteresis)
 	}
+	common.DebugPrintf("Mirror [%s] hysteresis = %d (IPv4: %d, IPv6: %d)\n",
+			name, mirror.Status.Hysteresis,
+			mirror.Status.Hysteresis4, mirror.Status.Hysteresis6)
 }
 
+// Change the online state only after the check result has differed from
+// it for the configured number of consecutive times.
+//
+// Return true if the state changed.
+//
+func applyHysteresis(online *bool, hysteresis *int, status bool) bool {
+	if *online == status {
+		*hysteresis = 0
+		return false
+	}
 
-// Check the given HTTP/HTTPS URL to determine whether it's accessible.
+	*hysteresis++
+	if *hysteresis < appConfig.Monitor.Hysteresis {
+		return false
+	}
+	*hysteresis = 0
+	*online = status
+	return true
+}
+
+
+// Check the given HTTP/HTTPS URL to determine whether it's accessible
+// over the network ("tcp4" or "tcp6"), i.e., responds with one of the
+// expected status codes.  The certificate chain of an HTTPS URL is
+// recorded for checkCerts().
 //
-func httpCheck(u *url.URL) (bool, error) {
+func httpCheck(u *url.URL, network string,
+		cfg *common.CheckConfig) (bool, error) {
 	if u.Scheme != "http" && u.Scheme != "https" {
 		return false, fmt.Errorf("Invalid HTTP(s) URL: %v", u.String())
 	}
 
-	timeout := appConfig.Monitor.Timeout * time.Second
+	client := newHTTPClient(u, network, cfg.Timeout, cfg)
+	req, err := newHTTPRequest(u, cfg)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	recordCerts(u, resp.TLS)
+
+	if !hasStatusCode(cfg.StatusCodes, resp.StatusCode) {
+		return false, fmt.Errorf("Status code (%d) not in %v",
+				resp.StatusCode, cfg.StatusCodes)
+	}
+	if cfg.HasContentChecks() {
+		if err := checkContent(resp.Body, cfg); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// Create an HTTP client that dials over the network ("tcp4", "tcp6" or
+// "tcp" for any), with the TLS setting of the mirror.
+//
+func newHTTPClient(u *url.URL, network string, timeout time.Duration,
+		cfg *common.CheckConfig) *http.Client {
+	dialer := &net.Dialer{ Timeout: timeout }
 	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
 	tr.TLSClientConfig = &tls.Config{
-		InsecureSkipVerify: !appConfig.Monitor.TLSVerify,
+		InsecureSkipVerify: !cfg.TLSVerify,
 		ServerName: u.Hostname(),
 	}
-	client := &http.Client{
+	return &http.Client{
 		Timeout: timeout,
 		Transport: tr,
 	}
+}
 
+// Create a GET request of the URL with the headers of the mirror.
+//
+func newHTTPRequest(u *url.URL, cfg *common.CheckConfig) (*http.Request, error) {
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	req.Host = u.Host
 	req.Header.Set("Accept", "*/*")
 	req.Header.Set("User-Agent", appConfig.Monitor.UserAgent)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return false, err
+	for k, v := range cfg.Headers {
+		req.Header.Set(k, v)
 	}
-	defer resp.Body.Close()
+	return req, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return false, fmt.Errorf("Status code (%d) != OK",
-				resp.StatusCode)
+func hasStatusCode(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
 	}
-
-	return true, nil
+	return false
 }
 
 
-// Check the given FTP URL to determine whether it's accessible.
+// Check the given FTP URL to determine whether it's accessible over the
+// network ("tcp4" or "tcp6"), i.e., the directory or the file (if the
+// path has no trailing slash) exists, and the file has the expected
+// content if configured.
 //
-func ftpCheck(u *url.URL) (bool, error) {
+func ftpCheck(u *url.URL, network string,
+		cfg *common.CheckConfig) (bool, error) {
 	if u.Scheme != "ftp" {
 		return false, fmt.Errorf("Invalid FTP URL: %v", u.String())
 	}
@@ -160,8 +356,13 @@ func ftpCheck(u *url.URL) (bool, error) {
 		addr += ":21"
 	}
 
-	timeout := appConfig.Monitor.Timeout * time.Second
-	conn, err := ftp.Dial(addr, ftp.DialWithTimeout(timeout))
+	timeout := cfg.Timeout
+	dialer := &net.Dialer{ Timeout: timeout }
+	conn, err := ftp.Dial(addr, ftp.DialWithTimeout(timeout),
+			ftp.DialWithDialFunc(func(_, addr string) (net.Conn, error) {
+				// Also used for the data connections
+				return dialer.Dial(network, addr)
+			}))
 	if err != nil {
 		return false, err
 	}
@@ -170,7 +371,20 @@ func ftpCheck(u *url.URL) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	err = conn.ChangeDir(u.Path)
+	if strings.HasSuffix(u.Path, "/") {
+		err = conn.ChangeDir(u.Path)
+	} else if cfg.HasContentChecks() {
+		var resp *ftp.Response
+		resp, err = conn.Retr(u.Path)
+		if err == nil {
+			err = checkContent(resp, cfg)
+			// NOTE: Closing an unfinished transfer may fail, but
+			// the content has been checked.
+			resp.Close()
+		}
+	} else {
+		_, err = conn.FileSize(u.Path)
+	}
 	if err != nil {
 		return false, err
 	}
@@ -184,17 +398,29 @@ func ftpCheck(u *url.URL) (bool, error) {
 }
 
 
+// Name of the mirror event corresponding to the status.
+//
+func eventName(status bool) string {
+	if status {
+		return "UP"
+	}
+	return "DOWN"
+}
+
+
 // Publish the mirror event by invoking the configured notification
-// executable.
+// executable, unless the mirror is under maintenance.
 //
-func notifyExec(name string, status bool) {
+func notifyExec(name string, event string) {
 	if appConfig.Monitor.NotifyExec == "" {
 		return
 	}
-
-	event := "DOWN"
-	if status {
-		event = "UP"
+	if m, ok := appConfig.Mirrors[name]; ok {
+		if a := m.AdminState(time.Now()); a != nil {
+			common.DebugPrintf("Mirror [%s] in %s state; " +
+					"notification suppressed.\n", name, a.State)
+			return
+		}
 	}
 
 	timeout := appConfig.Monitor.ExecTimeout * time.Second
@@ -1,8 +1,17 @@
 package monitor
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DragonFlyBSD/mirrorselect/common"
 )
@@ -18,7 +27,8 @@ func TestHttpCheck(t *testing.T) {
 	appConfig.Monitor.TLSVerify = true
 	for _, utext := range ok_urls {
 		u, _ := url.Parse(utext)
-		status, err := httpCheck(u)
+		status, err := httpCheck(u, "tcp4",
+				appConfig.Monitor.CheckConfig(nil))
 		if err != nil || !status {
 			t.Errorf("httpCheck(%q) = (%v, %v); want %v\n",
 					u, status, err, true)
@@ -28,7 +38,8 @@ func TestHttpCheck(t *testing.T) {
 	appConfig.Monitor.TLSVerify = false
 	for _, utext := range ok_urls {
 		u, _ := url.Parse(utext)
-		status, err := httpCheck(u)
+		status, err := httpCheck(u, "tcp4",
+				appConfig.Monitor.CheckConfig(nil))
 		if err != nil || !status {
 			t.Errorf("httpCheck(%q) = (%v, %v); want %v\n",
 					u, status, err, true)
@@ -41,7 +52,8 @@ func TestHttpCheck(t *testing.T) {
 	}
 	for _, utext := range fail_urls {
 		u, _ := url.Parse(utext)
-		status, err := httpCheck(u)
+		status, err := httpCheck(u, "tcp4",
+				appConfig.Monitor.CheckConfig(nil))
 		if err == nil || status {
 			t.Errorf("httpCheck(%q) = (%v, %v); want %v\n",
 					u, status, err, false)
@@ -54,7 +66,8 @@ func TestHttpCheck(t *testing.T) {
 	}
 	for _, utext := range invalid_urls {
 		u, _ := url.Parse(utext)
-		status, err := httpCheck(u)
+		status, err := httpCheck(u, "tcp4",
+				appConfig.Monitor.CheckConfig(nil))
 		if err == nil || status {
 			t.Errorf("httpCheck(%q) = (%v, %v); want %v\n",
 					u, status, err, false)
@@ -70,7 +83,8 @@ func TestFtpCheck(t *testing.T) {
 	}
 	for _, utext := range ok_urls {
 		u, _ := url.Parse(utext)
-		status, err := ftpCheck(u)
+		status, err := ftpCheck(u, "tcp4",
+				appConfig.Monitor.CheckConfig(nil))
 		if err != nil || !status {
 			t.Errorf("ftpCheck(%q) = (%v, %v); want %v\n",
 					u, status, err, true)
@@ -83,7 +97,8 @@ func TestFtpCheck(t *testing.T) {
 	}
 	for _, utext := range fail_urls {
 		u, _ := url.Parse(utext)
-		status, err := ftpCheck(u)
+		status, err := ftpCheck(u, "tcp4",
+				appConfig.Monitor.CheckConfig(nil))
 		if err == nil || status {
 			t.Errorf("ftpCheck(%q) = (%v, %v); want %v\n",
 					u, status, err, false)
@@ -96,7 +111,8 @@ func TestFtpCheck(t *testing.T) {
 	}
 	for _, utext := range invalid_urls {
 		u, _ := url.Parse(utext)
-		status, err := ftpCheck(u)
+		status, err := ftpCheck(u, "tcp4",
+				appConfig.Monitor.CheckConfig(nil))
 		if err == nil || status {
 			t.Errorf("ftpCheck(%q) = (%v, %v); want %v\n",
 					u, status, err, false)
@@ -126,20 +142,531 @@ func TestHysteresis(t *testing.T) {
 		}
 	}
 
-	updateMirror("test", mirror, true)
+	updateMirror("test", mirror, true, true)
 	assertStatus(0, true)
-	updateMirror("test", mirror, false)
+	updateMirror("test", mirror, false, false)
 	assertStatus(1, true)
-	updateMirror("test", mirror, false)
+	updateMirror("test", mirror, false, false)
 	assertStatus(0, false)
-	updateMirror("test", mirror, false)
+	updateMirror("test", mirror, false, false)
 	assertStatus(0, false)
-	updateMirror("test", mirror, true)
+	updateMirror("test", mirror, true, true)
 	assertStatus(1, false)
-	updateMirror("test", mirror, false)
+	updateMirror("test", mirror, false, false)
 	assertStatus(0, false)
-	updateMirror("test", mirror, true)
+	updateMirror("test", mirror, true, true)
 	assertStatus(1, false)
-	updateMirror("test", mirror, true)
+	updateMirror("test", mirror, true, true)
 	assertStatus(0, true)
 }
+
+
+func TestHttpCheckFamily(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	// The test server listens on 127.0.0.1 only.
+	u, _ := url.Parse(ts.URL)
+	cfg := appConfig.Monitor.CheckConfig(nil)
+	if status, err := httpCheck(u, "tcp4", cfg); err != nil || !status {
+		t.Errorf("httpCheck(%q, tcp4) = (%v, %v); want %v\n",
+				u, status, err, true)
+	}
+	if status, err := httpCheck(u, "tcp6", cfg); err == nil || status {
+		t.Errorf("httpCheck(%q, tcp6) = (%v, %v); want %v\n",
+				u, status, err, false)
+	}
+}
+
+
+func TestHysteresisFamilies(t *testing.T) {
+	appConfig.Monitor.Hysteresis = 2
+	mirror := &common.Mirror{
+		Name: "Test",
+		Status: common.MirrorStatus{
+			Online: true,
+			Online4: true,
+			Online6: true,
+		},
+	}
+
+	assertStatus := func(online, online4, online6 bool) {
+		t.Helper()
+		s := mirror.Status
+		if s.Online != online || s.Online4 != online4 ||
+		   s.Online6 != online6 {
+			t.Errorf("updateMirror() failed: online = (%v, %v, %v); " +
+					"want (%v, %v, %v)\n",
+					s.Online, s.Online4, s.Online6,
+					online, online4, online6)
+		}
+	}
+
+	// Broken IPv6
+	updateMirror("test", mirror, true, false)
+	assertStatus(true, true, true)
+	updateMirror("test", mirror, true, false)
+	assertStatus(true, true, false)
+	// IPv4 down as well
+	updateMirror("test", mirror, false, false)
+	assertStatus(true, true, false)
+	updateMirror("test", mirror, false, false)
+	assertStatus(false, false, false)
+	// IPv6 back only
+	updateMirror("test", mirror, false, true)
+	assertStatus(false, false, false)
+	updateMirror("test", mirror, false, true)
+	assertStatus(true, false, true)
+}
+
+
+// Serve the connections on a local listener with the handler.
+//
+func serveLocal(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+
+func TestRsyncCheck(t *testing.T) {
+	appConfig.Monitor.Timeout = 2
+	addr := serveLocal(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "@RSYNCD: 31.0 sha512 sha256 md5\n")
+		if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "@RSYNCD: ") {
+			return
+		}
+		if line, _ := r.ReadString('\n'); line != "\n" {
+			fmt.Fprintf(conn, "@ERROR: Unknown module\n")
+			return
+		}
+		fmt.Fprintf(conn, "Welcome to the test mirror\n\n")
+		fmt.Fprintf(conn, "dragonfly      \tDragonFly BSD\n")
+		fmt.Fprintf(conn, "dports         \tDPorts packages\n")
+		fmt.Fprintf(conn, "@RSYNCD: EXIT\n")
+	})
+	badAddr := serveLocal(t, func(conn net.Conn) {
+		fmt.Fprintf(conn, "SSH-2.0-OpenSSH\r\n")
+	})
+
+	cases := []struct {
+		url string
+		ok bool
+	}{
+		{ "rsync://" + addr + "/", true },
+		{ "rsync://" + addr + "/dports/", true },
+		{ "rsync://" + addr + "/dragonfly/iso-images/", true },
+		{ "rsync://" + addr + "/freebsd/", false },
+		{ "rsync://" + badAddr + "/dports/", false },
+		{ "http://" + addr + "/dports/", false },
+	}
+	for _, tc := range cases {
+		u, _ := url.Parse(tc.url)
+		status, err := rsyncCheck(u, "tcp4",
+				appConfig.Monitor.CheckConfig(nil))
+		if status != tc.ok || (err == nil) != tc.ok {
+			t.Errorf("rsyncCheck(%q) = (%v, %v); want %v\n",
+					tc.url, status, err, tc.ok)
+		}
+	}
+}
+
+
+func TestTcpCheck(t *testing.T) {
+	appConfig.Monitor.Timeout = 2
+	addr := serveLocal(t, func(conn net.Conn) {})
+	ln, _ := net.Listen("tcp4", "127.0.0.1:0")
+	closedAddr := ln.Addr().String()
+	ln.Close()
+
+	cases := []struct {
+		url string
+		network string
+		ok bool
+	}{
+		{ "tcp://" + addr, "tcp4", true },
+		{ "tcp://" + addr + "/", "tcp4", true },
+		{ "tcp://" + addr, "tcp6", false },
+		{ "tcp://" + closedAddr, "tcp4", false },
+		{ "tcp://127.0.0.1", "tcp4", false },
+		{ "http://" + addr, "tcp4", false },
+	}
+	for _, tc := range cases {
+		u, _ := url.Parse(tc.url)
+		status, err := tcpCheck(u, tc.network,
+				appConfig.Monitor.CheckConfig(nil))
+		if status != tc.ok || (err == nil) != tc.ok {
+			t.Errorf("tcpCheck(%q, %s) = (%v, %v); want %v\n",
+					tc.url, tc.network, status, err, tc.ok)
+		}
+	}
+}
+
+
+func TestCheckMirrorURLs(t *testing.T) {
+	saved := appConfig.Mirrors
+	defer func() { appConfig.Mirrors = saved }()
+
+	appConfig.Mirrors = map[string]*common.Mirror{
+		"test": {
+			URL: "https://mirror.example.org/dports/",
+			URLs: []string{
+				"rsync://mirror.example.org/dports/",
+				"tcp://mirror.example.org:873",
+			},
+		},
+	}
+	if err := CheckMirrorURLs(); err != nil {
+		t.Errorf("CheckMirrorURLs() failed: %v", err)
+	}
+
+	appConfig.Mirrors["test"].URLs = append(appConfig.Mirrors["test"].URLs,
+			"gopher://mirror.example.org/")
+	if err := CheckMirrorURLs(); err == nil {
+		t.Errorf("CheckMirrorURLs() succeeded, want error")
+	}
+}
+
+
+func TestCheckMirror(t *testing.T) {
+	appConfig.Monitor.Timeout = 2
+	appConfig.Monitor.Hysteresis = 1
+	appConfig.Monitor.Families = []string{ "ipv4" }
+
+	ts := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	ln, _ := net.Listen("tcp4", "127.0.0.1:0")
+	closedURL := "https://" + ln.Addr().String() + "/dports/"
+	ln.Close()
+
+	mirror := &common.Mirror{
+		Name: "Test",
+		URL: closedURL,
+		URLs: []string{
+			ts.URL + "/dports/",
+			"tcp://" + ln.Addr().String(),
+		},
+		Status: common.MirrorStatus{
+			Online: true,
+			Online4: true,
+			Online6: true,
+			URLs: map[string]*common.URLStatus{},
+		},
+	}
+	for _, u := range mirror.AllURLs() {
+		mirror.Status.URLs[u] = &common.URLStatus{ Online: true }
+	}
+
+	checkMirror("test", mirror)
+	if !mirror.Status.Online || !mirror.Status.Online4 {
+		t.Errorf("checkMirror() failed: mirror offline, " +
+				"want online via the HTTP URL")
+	}
+	for u, want := range map[string]bool{
+		closedURL: false,
+		ts.URL + "/dports/": true,
+		"tcp://" + ln.Addr().String(): false,
+	} {
+		st := mirror.Status.URLs[u]
+		if st.Online != want || (st.Error == "") != want {
+			t.Errorf("checkMirror() failed: URL (%s) online = %v " +
+					"(error: %q), want %v", u, st.Online,
+					st.Error, want)
+		}
+	}
+
+	// Offline once all the pkg URLs are down
+	ts.Close()
+	checkMirror("test", mirror)
+	if mirror.Status.Online {
+		t.Errorf("checkMirror() failed: mirror online, want offline")
+	}
+}
+
+
+func TestCheckCerts(t *testing.T) {
+	appConfig.Monitor.Timeout = 2
+	appConfig.Monitor.CertWarning = 14
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	u := ts.URL + "/dports/"
+	mirror := &common.Mirror{
+		Name: "Test",
+		URL: u,
+		Status: common.MirrorStatus{
+			URLs: map[string]*common.URLStatus{
+				u: &common.URLStatus{ Online: true },
+			},
+		},
+	}
+
+	checkCerts("test", mirror, time.Now())
+	cs := mirror.Status.URLs[u].Cert
+	if cs == nil || len(cs.Chain) == 0 || cs.Error != "" {
+		t.Fatalf("checkCerts() failed: cert = %+v", cs)
+	}
+	if cs.NotAfter != ts.Certificate().NotAfter {
+		t.Errorf("checkCerts() failed: not_after = %v, want %v",
+				cs.NotAfter, ts.Certificate().NotAfter)
+	}
+	if cs.Expiring || mirror.Status.CertExpiring {
+		t.Errorf("checkCerts() failed: expiring, want not")
+	}
+
+	checkCerts("test", mirror, cs.NotAfter.Add(-24 * time.Hour))
+	if !mirror.Status.URLs[u].Cert.Expiring || !mirror.Status.CertExpiring {
+		t.Errorf("checkCerts() failed: not expiring, want expiring")
+	}
+
+	// Warned upon entering the window, and then once a day
+	warned := cs.NotAfter.Add(-24 * time.Hour)
+	for _, tc := range []struct {
+		now, warned time.Time
+	}{
+		{ warned.Add(time.Minute), warned },
+		{ warned.Add(23 * time.Hour), warned },
+		{ warned.Add(24 * time.Hour), warned.Add(24 * time.Hour) },
+	} {
+		checkCerts("test", mirror, tc.now)
+		got := mirror.Status.URLs[u].Cert.Warned
+		if !got.Equal(tc.warned) {
+			t.Errorf("checkCerts(%v) failed: warned at %v, want %v",
+					tc.now, got, tc.warned)
+		}
+	}
+
+	// The last known chain is kept if the server is gone.
+	ts.Close()
+	checkCerts("test", mirror, time.Now())
+	cs = mirror.Status.URLs[u].Cert
+	if cs.Error == "" || len(cs.Chain) == 0 || cs.Expiring {
+		t.Errorf("checkCerts() failed: cert = %+v", cs)
+	}
+}
+
+
+func TestCheckCertsReuse(t *testing.T) {
+	appConfig.Monitor.Timeout = 2
+	appConfig.Monitor.CertWarning = 14
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	rawurl := ts.URL + "/dports/"
+	mirror := &common.Mirror{
+		Name: "Test",
+		URL: rawurl,
+		Status: common.MirrorStatus{
+			URLs: map[string]*common.URLStatus{
+				rawurl: &common.URLStatus{ Online: true },
+			},
+		},
+	}
+	cfg := *appConfig.Monitor.CheckConfig(nil)
+	cfg.TLSVerify = false
+	cfg.StatusCodes = []int{ http.StatusOK }
+
+	u, _ := url.Parse(rawurl)
+	if status, err := httpCheck(u, "tcp", &cfg); !status {
+		t.Fatalf("httpCheck(%s) failed: %v", rawurl, err)
+	}
+
+	// No more handshakes: the chain of the HTTPS check is used.
+	ts.Close()
+	checkCerts("test", mirror, time.Now())
+	cs := mirror.Status.URLs[rawurl].Cert
+	if cs == nil || cs.Error != "" ||
+	   cs.NotAfter != ts.Certificate().NotAfter {
+		t.Errorf("checkCerts() failed: cert = %+v", cs)
+	}
+}
+
+
+func TestCheckURLSettings(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/dports/LATEST/meta.conf" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}))
+	defer ts.Close()
+
+	appConfig.Monitor.Families = []string{ "ipv4" }
+	rawurl := ts.URL + "/dports/"
+	cases := []struct {
+		override common.MirrorMonitorConfig
+		want bool
+	}{
+		{ common.MirrorMonitorConfig{}, false },
+		{ common.MirrorMonitorConfig{
+			Path: "LATEST/meta.conf",
+		}, false },
+		{ common.MirrorMonitorConfig{
+			Path: "/LATEST/meta.conf",
+			Headers: map[string]string{ "x-token": "secret" },
+		}, true },
+		{ common.MirrorMonitorConfig{
+			Headers: map[string]string{ "x-token": "secret" },
+			StatusCodes: []int{ http.StatusNotFound },
+		}, true },
+	}
+	for _, tc := range cases {
+		cfg := appConfig.Monitor.CheckConfig(&tc.override)
+		status, _, _, err := checkURL("test", rawurl, cfg)
+		if status != tc.want {
+			t.Errorf("checkURL(%q, %+v) = (%v, %v); want %v",
+					rawurl, tc.override, status, err, tc.want)
+		}
+	}
+}
+
+
+func TestCheckContent(t *testing.T) {
+	const content = "version = 1;\npacksite = \"pkg\";\n"
+	sum := sha256.Sum256([]byte(content))
+	good := hex.EncodeToString(sum[:])
+	sum = sha256.Sum256([]byte(content + "\n"))
+	bad := hex.EncodeToString(sum[:])
+	cases := []struct {
+		cfg common.CheckConfig
+		ok bool
+	}{
+		{ common.CheckConfig{ Expect: "packsite" }, true },
+		{ common.CheckConfig{ Expect: "<html>" }, false },
+		{ common.CheckConfig{ ExpectRegex: `version = \d+;` }, true },
+		{ common.CheckConfig{ ExpectRegex: `^<!DOCTYPE` }, false },
+		{ common.CheckConfig{ ExpectSHA256: good }, true },
+		{ common.CheckConfig{ ExpectSHA256: bad }, false },
+		// Only the first bytes are matched.
+		{ common.CheckConfig{ Expect: "packsite", MaxBytes: 8 }, false },
+		{ common.CheckConfig{ Expect: "version", MaxBytes: 8 }, true },
+		{ common.CheckConfig{ ExpectSHA256: good, MaxBytes: 8 }, false },
+	}
+	for _, tc := range cases {
+		if tc.cfg.MaxBytes == 0 {
+			tc.cfg.MaxBytes = 1024
+		}
+		tc.cfg.Interval, tc.cfg.Timeout = time.Second, time.Second
+		if err := tc.cfg.Validate(); err != nil {
+			t.Fatalf("Validate(%+v) failed: %v", tc.cfg, err)
+		}
+		err := checkContent(strings.NewReader(content), &tc.cfg)
+		if (err == nil) != tc.ok {
+			t.Errorf("checkContent(%+v) = %v; want ok = %v",
+					tc.cfg, err, tc.ok)
+		}
+	}
+
+	// Not compiled without Validate()
+	cfg := common.CheckConfig{ ExpectRegex: `version`, MaxBytes: 1024 }
+	if err := checkContent(strings.NewReader(content), &cfg); err == nil {
+		t.Errorf("checkContent(%+v) succeeded, want error", cfg)
+	}
+}
+
+
+func TestHttpCheckContent(t *testing.T) {
+	const content = "version = 1;\n"
+	ts := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, content)
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL + "/meta.conf")
+	sum := sha256.Sum256([]byte(content))
+	cfg := appConfig.Monitor.CheckConfig(&common.MirrorMonitorConfig{
+		ExpectSHA256: hex.EncodeToString(sum[:]),
+	})
+	if status, err := httpCheck(u, "tcp4", cfg); err != nil || !status {
+		t.Errorf("httpCheck(%q, sha256) = (%v, %v); want true",
+				u, status, err)
+	}
+
+	cfg.MaxBytes = 4
+	if status, err := httpCheck(u, "tcp4", cfg); err == nil || status {
+		t.Errorf("httpCheck(%q, sha256, max_bytes = 4) = (%v, %v); " +
+				"want false", u, status, err)
+	}
+}
+
+
+func TestProbeThroughput(t *testing.T) {
+	data := make([]byte, 256 << 10)
+	ts := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dports/test.bin" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	appConfig.Monitor.ThroughputPath = "test.bin"
+	appConfig.Monitor.ThroughputInterval = 3600
+	appConfig.Monitor.ThroughputBytes = 128 << 10
+	appConfig.Monitor.ThroughputTimeout = 5
+	defer func() { appConfig.Monitor.ThroughputPath = "" }()
+
+	u := ts.URL + "/dports/"
+	mirror := &common.Mirror{
+		URL: u,
+		Status: common.MirrorStatus{
+			Online: true,
+			URLs: map[string]*common.URLStatus{
+				u: &common.URLStatus{ Online: true },
+			},
+		},
+	}
+	now := time.Now()
+	probeThroughput("test", mirror, now)
+	if mirror.Status.Throughput <= 0 || !mirror.Status.ThroughputTime.Equal(now) {
+		t.Fatalf("probeThroughput() failed: throughput = %d at %v",
+				mirror.Status.Throughput,
+				mirror.Status.ThroughputTime)
+	}
+
+	// Not due yet
+	mirror.Status.Throughput = 1
+	probeThroughput("test", mirror, now.Add(time.Minute))
+	if mirror.Status.Throughput != 1 {
+		t.Errorf("probeThroughput() failed: probed before the interval")
+	}
+
+	// Reset to unknown on failure
+	appConfig.Monitor.ThroughputPath = "missing.bin"
+	probeThroughput("test", mirror, now.Add(time.Hour))
+	if mirror.Status.Throughput != 0 {
+		t.Errorf("probeThroughput() failed: throughput = %d, want 0",
+				mirror.Status.Throughput)
+	}
+}
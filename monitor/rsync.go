@@ -0,0 +1,92 @@
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+const (
+	rsyncPort	= "873"
+	// Protocol version announced to the rsync daemon
+	rsyncVersion	= "30.0"
+	// Cap the lines read from the daemon, e.g., a long MOTD.
+	rsyncMaxLines	= 1000
+)
+
+
+// Check the given rsync:// URL by requesting the module listing from the
+// rsync daemon and looking for the module of the URL path, if any.
+//
+// Reference: rsync(1) "CONNECTING TO AN RSYNC DAEMON" and the daemon
+// protocol in clientserver.c of rsync.
+//
+func rsyncCheck(u *url.URL, network string,
+		cfg *common.CheckConfig) (bool, error) {
+	if u.Scheme != "rsync" {
+		return false, fmt.Errorf("Invalid rsync URL: %v", u.String())
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), rsyncPort)
+	}
+	module := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)[0]
+
+	timeout := cfg.Timeout
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	r := bufio.NewReader(conn)
+	greeting, err := r.ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	if !strings.HasPrefix(greeting, "@RSYNCD: ") {
+		return false, fmt.Errorf("Invalid rsync greeting: %q",
+				strings.TrimSpace(greeting))
+	}
+
+	// Send our version and then an empty module name to list modules.
+	if _, err := fmt.Fprintf(conn, "@RSYNCD: %s\n\n", rsyncVersion);
+	   err != nil {
+		return false, err
+	}
+
+	modules := map[string]bool{}
+	for i := 0; i < rsyncMaxLines; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "@RSYNCD: EXIT":
+			if module != "" && !modules[module] {
+				return false, fmt.Errorf(
+						"rsync module not found: %s", module)
+			}
+			return true, nil
+		case strings.HasPrefix(line, "@ERROR"):
+			return false, fmt.Errorf("rsync error: %s", line)
+		case strings.HasPrefix(line, "@RSYNCD: "):
+			// e.g., "@RSYNCD: OK"
+			continue
+		}
+		// Module lines: "<name>\t<comment>"; others are MOTD.
+		if name := strings.TrimSpace(strings.SplitN(line, "\t", 2)[0]);
+		   name != "" {
+			modules[name] = true
+		}
+	}
+	return false, fmt.Errorf("Too many lines from rsync daemon")
+}
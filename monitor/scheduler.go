@@ -0,0 +1,118 @@
+package monitor
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+	"github.com/DragonFlyBSD/mirrorselect/workerpool"
+)
+
+
+// Schedule the checks of each mirror on its own: at the configured
+// interval normally, at the retry interval while its state is in flux
+// (i.e., the hysteresis has counted opposite results), and with an
+// exponential backoff up to the max interval while it stays down.
+//
+// A mirror is only queued again after its previous check finished, and
+// every delay is randomized by the jitter, so that the checks are spread
+// out instead of hitting all mirrors at once.  The mirrors disabled via
+// the admin API are skipped.
+//
+type scheduler struct {
+	pool	*workerpool.Pool
+	mu	sync.Mutex
+	rand	*rand.Rand
+}
+
+func newScheduler(pool *workerpool.Pool) *scheduler {
+	return &scheduler{
+		pool: pool,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Check the mirror repeatedly.
+//
+func (s *scheduler) run(name string, mirror *common.Mirror) {
+	done := make(chan bool)
+	task := workerpool.NewTask(func(data interface{}) error {
+		checkMirror(name, mirror)
+		done <- true
+		return nil
+	}, nil)
+
+	cfg := checkConfig(mirror)
+	// Spread the first checks within the retry interval.
+	delay := time.Duration(s.float64() * float64(retryInterval(cfg)))
+	down := 0
+	for {
+		mirror.Status.NextCheck = time.Now().Add(delay)
+		time.Sleep(delay)
+		if a := mirror.AdminState(time.Now()); a != nil &&
+		   a.State == common.AdminDisabled {
+			common.DebugPrintf("Mirror [%s] disabled; check skipped.\n",
+					name)
+			delay = s.jitter(cfg.Interval)
+			continue
+		}
+		s.pool.AddTask(task)
+		<-done
+
+		delay, down = nextDelay(&mirror.Status, cfg, down)
+		delay = s.jitter(delay)
+		common.DebugPrintf("Mirror [%s] next check in %v\n",
+				name, delay.Round(time.Second))
+	}
+}
+
+func (s *scheduler) float64() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Float64()
+}
+
+// Randomize the delay within +/- the jitter fraction.
+//
+func (s *scheduler) jitter(delay time.Duration) time.Duration {
+	j := appConfig.Monitor.Jitter
+	return time.Duration(float64(delay) * (1 + j * (2 * s.float64() - 1)))
+}
+
+
+// Get the delay before the next check of the mirror, given the number
+// of the consecutive checks it has been down, which is also updated and
+// returned.
+//
+func nextDelay(st *common.MirrorStatus, cfg *common.CheckConfig,
+		down int) (time.Duration, int) {
+	if st.Hysteresis > 0 || st.Hysteresis4 > 0 || st.Hysteresis6 > 0 {
+		return retryInterval(cfg), 0
+	}
+	if st.Online {
+		return cfg.Interval, 0
+	}
+
+	down++
+	max := appConfig.Monitor.MaxInterval * time.Second
+	delay := cfg.Interval
+	for i := 1; i < down && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max && max > cfg.Interval {
+		delay = max
+	}
+	return delay, down
+}
+
+// Get the interval to recheck a mirror whose state is in flux, which is
+// no longer than its normal interval.
+//
+func retryInterval(cfg *common.CheckConfig) time.Duration {
+	retry := appConfig.Monitor.RetryInterval * time.Second
+	if retry > cfg.Interval {
+		retry = cfg.Interval
+	}
+	return retry
+}
@@ -0,0 +1,63 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+	"github.com/DragonFlyBSD/mirrorselect/workerpool"
+)
+
+
+func TestNextDelay(t *testing.T) {
+	appConfig.Monitor.RetryInterval = 60
+	appConfig.Monitor.MaxInterval = 4 * 3600
+	cfg := &common.CheckConfig{ Interval: time.Hour }
+
+	online := &common.MirrorStatus{ Online: true }
+	if d, down := nextDelay(online, cfg, 0); d != time.Hour || down != 0 {
+		t.Errorf("nextDelay(online) = (%v, %d); want (1h, 0)", d, down)
+	}
+
+	flux := &common.MirrorStatus{ Online: false, Hysteresis6: 1 }
+	if d, down := nextDelay(flux, cfg, 3); d != time.Minute || down != 0 {
+		t.Errorf("nextDelay(in flux) = (%v, %d); want (1m, 0)", d, down)
+	}
+
+	// Backoff: 1h, 2h, 4h, 4h ...
+	offline := &common.MirrorStatus{ Online: false }
+	down := 0
+	for _, want := range []time.Duration{
+		time.Hour, 2 * time.Hour, 4 * time.Hour, 4 * time.Hour,
+	} {
+		var d time.Duration
+		d, down = nextDelay(offline, cfg, down)
+		if d != want {
+			t.Errorf("nextDelay(offline, %d) = %v; want %v",
+					down, d, want)
+		}
+	}
+
+	// The retry interval is capped by the interval.
+	cfg.Interval = 30 * time.Second
+	if d, _ := nextDelay(flux, cfg, 0); d != cfg.Interval {
+		t.Errorf("nextDelay(in flux) = %v; want %v", d, cfg.Interval)
+	}
+}
+
+
+func TestJitter(t *testing.T) {
+	appConfig.Monitor.Jitter = 0.1
+	s := newScheduler(workerpool.NewPool(nil, 1))
+	for i := 0; i < 100; i++ {
+		d := s.jitter(time.Hour)
+		if d < 54 * time.Minute || d > 66 * time.Minute {
+			t.Fatalf("jitter(1h) = %v; want within 1h +/- 10%%", d)
+		}
+	}
+
+	appConfig.Monitor.Jitter = 0
+	if d := s.jitter(time.Hour); d != time.Hour {
+		t.Errorf("jitter(1h) = %v with no jitter; want 1h", d)
+	}
+}
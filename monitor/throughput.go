@@ -0,0 +1,133 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DragonFlyBSD/mirrorselect/common"
+)
+
+
+// Probe the download throughput of the mirror if enabled and due, i.e.,
+// the last probe was at least 'throughput_interval' ago.
+//
+// The test file is downloaded from the first online HTTP(S) URL of the
+// mirror; the result is reset to unknown (0) if the probe fails.
+//
+func probeThroughput(name string, mirror *common.Mirror, now time.Time) {
+	cfg := &appConfig.Monitor
+	st := &mirror.Status
+	if cfg.ThroughputPath == "" || !st.Online {
+		return
+	}
+	if !st.ThroughputTime.IsZero() &&
+	   now.Sub(st.ThroughputTime) < cfg.ThroughputInterval * time.Second {
+		return
+	}
+
+	u := throughputURL(mirror)
+	if u == nil {
+		return
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" +
+			strings.TrimPrefix(cfg.ThroughputPath, "/")
+
+	st.ThroughputTime = now
+	bps, err := measureThroughput(u, checkConfig(mirror))
+	entry := common.WithFields(common.Fields{
+		"mirror": name,
+		"url": u.String(),
+		"throughput": bps,
+	})
+	if err != nil {
+		st.Throughput = 0
+		entry.Warnf("Mirror [%s] throughput probe (%s) failed: %v\n",
+				name, u.String(), err)
+		return
+	}
+	st.Throughput = bps
+	entry.Infof("Mirror [%s] throughput: %d KiB/s\n", name, bps / 1024)
+}
+
+// Get the first online HTTP(S) URL of the mirror, if any.
+//
+func throughputURL(mirror *common.Mirror) *url.URL {
+	for _, rawurl := range mirror.PkgURLs() {
+		u, err := url.Parse(rawurl)
+		st := mirror.Status.URLs[rawurl]
+		if err != nil || st == nil || !st.Online {
+			continue
+		}
+		if u.Scheme == "http" || u.Scheme == "https" {
+			return u
+		}
+	}
+	return nil
+}
+
+
+// Download the URL up to 'throughput_bytes' (or within the timeout) and
+// return the sustained throughput in bytes per second, which is
+// measured from the first received data so that the connection setup
+// and the server's first-byte latency are excluded.
+//
+func measureThroughput(u *url.URL, cfg *common.CheckConfig) (int64, error) {
+	timeout := appConfig.Monitor.ThroughputTimeout * time.Second
+	client := newHTTPClient(u, "tcp", timeout, cfg)
+	req, err := newHTTPRequest(u, cfg)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Status code (%d) != OK", resp.StatusCode)
+	}
+
+	limit := appConfig.Monitor.ThroughputBytes
+	buf := make([]byte, 32 << 10)
+	var start time.Time
+	var n int64
+	for n < limit {
+		size := int64(len(buf))
+		if limit - n < size {
+			size = limit - n
+		}
+		m, err := resp.Body.Read(buf[:size])
+		if m > 0 {
+			if start.IsZero() {
+				// The first data is excluded.
+				start = time.Now()
+			} else {
+				n += int64(m)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() && n > 0 {
+			// Timed out on a slow mirror; use the data so far.
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	elapsed := time.Since(start)
+	if n == 0 || elapsed <= 0 {
+		return 0, fmt.Errorf("Too little data to measure")
+	}
+	return int64(float64(n) / elapsed.Seconds()), nil
+}